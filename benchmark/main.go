@@ -4,11 +4,13 @@ import (
 	"flag"
 	"fmt"
 	"github.com/carmooo/monkey_compiler/compiler"
+	"github.com/carmooo/monkey_compiler/lexer"
+	"github.com/carmooo/monkey_compiler/parser"
 	"github.com/carmooo/monkey_compiler/vm"
 	"github.com/carmooo/monkey_interpreter/evaluator"
-	"github.com/carmooo/monkey_interpreter/lexer"
+	interpreterLexer "github.com/carmooo/monkey_interpreter/lexer"
 	"github.com/carmooo/monkey_interpreter/object"
-	"github.com/carmooo/monkey_interpreter/parser"
+	interpreterParser "github.com/carmooo/monkey_interpreter/parser"
 	"time"
 )
 
@@ -33,11 +35,11 @@ func main() {
 	var duration time.Duration
 	var result object.Object
 
-	l := lexer.New(input)
-	p := parser.New(l)
-	program := p.ParseProgram()
-
 	if *engine == "vm" {
+		l := lexer.New(input)
+		p := parser.New(l)
+		program := p.ParseProgram()
+
 		comp := compiler.New()
 		err := comp.Compile(program)
 		if err != nil {
@@ -49,15 +51,19 @@ func main() {
 
 		start := time.Now()
 
-		err = machine.Run()
+		result, err = machine.RunProgram()
 		if err != nil {
 			fmt.Printf("vm error: %s", err)
 			return
 		}
 
 		duration = time.Since(start)
-		result = machine.LastPoppedStackElem()
 	} else {
+		// the evaluator walks the interpreter's own syntax tree
+		l := interpreterLexer.New(input)
+		p := interpreterParser.New(l)
+		program := p.ParseProgram()
+
 		env := object.NewEnvironment()
 		start := time.Now()
 		result = evaluator.Eval(program, env)
@@ -0,0 +1,465 @@
+// Package bridge converts between Go values and Monkey objects and binds
+// Go functions as builtins.
+//
+// Struct fields are converted to hash entries keyed by the field name,
+// which the `monkey:"name"` tag overrides. Fields tagged `monkey:"-"` and
+// unexported fields are skipped.
+package bridge
+
+import (
+	"fmt"
+	compilerObject "github.com/carmooo/monkey_compiler/object"
+	"github.com/carmooo/monkey_compiler/vm"
+	"github.com/carmooo/monkey_interpreter/object"
+	"math"
+	"math/big"
+	"reflect"
+	"strings"
+)
+
+var (
+	objectType = reflect.TypeOf((*object.Object)(nil)).Elem()
+	bigIntType = reflect.TypeOf((*big.Int)(nil))
+	errorType  = reflect.TypeOf((*error)(nil)).Elem()
+	callerType = reflect.TypeOf((*compilerObject.Caller)(nil)).Elem()
+)
+
+// ToMonkey converts a Go value into a Monkey object. Integers, floats,
+// strings, booleans, *big.Int, slices, arrays, maps, structs and pointers
+// to any of them are supported, as are functions, which become builtins
+// the same way Func binds them. nil becomes null and object.Object values
+// are returned unchanged. A value that contains itself is an error.
+func ToMonkey(v interface{}) (object.Object, error) {
+	return toMonkey(reflect.ValueOf(v), "", map[visit]string{})
+}
+
+// visit identifies a pointer, map or slice being converted. Slices sharing
+// their backing array are told apart by their length.
+type visit struct {
+	pointer uintptr
+	typ     reflect.Type
+	length  int
+}
+
+// toMonkey converts v, which is found at path. visiting holds the path of
+// every pointer, map and slice whose conversion is in progress, so a value
+// that contains itself is reported instead of recursing forever.
+func toMonkey(v reflect.Value, path string, visiting map[visit]string) (object.Object, error) {
+	if !v.IsValid() {
+		return vm.Null, nil
+	}
+
+	if v.Type().Implements(objectType) {
+		if (v.Kind() == reflect.Pointer || v.Kind() == reflect.Interface) && v.IsNil() {
+			return vm.Null, nil
+		}
+		return v.Interface().(object.Object), nil
+	}
+
+	if v.Type() == bigIntType {
+		if v.IsNil() {
+			return vm.Null, nil
+		}
+		return compilerObject.IntegerFromBig(v.Interface().(*big.Int)), nil
+	}
+
+	switch v.Kind() {
+	case reflect.Bool:
+		if v.Bool() {
+			return vm.True, nil
+		}
+		return vm.False, nil
+
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return &object.Integer{Value: v.Int()}, nil
+
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		if v.Uint() > math.MaxInt64 {
+			return &compilerObject.BigInteger{Value: new(big.Int).SetUint64(v.Uint())}, nil
+		}
+		return &object.Integer{Value: int64(v.Uint())}, nil
+
+	case reflect.Float32, reflect.Float64:
+		return &compilerObject.Float{Value: v.Float()}, nil
+
+	case reflect.String:
+		return &object.String{Value: v.String()}, nil
+
+	case reflect.Pointer, reflect.Interface:
+		if v.IsNil() {
+			return vm.Null, nil
+		}
+		if v.Kind() == reflect.Pointer {
+			leave, err := enter(v, path, visiting)
+			if err != nil {
+				return nil, err
+			}
+			defer leave()
+		}
+		return toMonkey(v.Elem(), path, visiting)
+
+	case reflect.Slice, reflect.Array:
+		if v.Kind() == reflect.Slice {
+			if v.IsNil() {
+				return vm.Null, nil
+			}
+			leave, err := enter(v, path, visiting)
+			if err != nil {
+				return nil, err
+			}
+			defer leave()
+		}
+
+		elements := make([]object.Object, v.Len())
+		for i := range elements {
+			element, err := toMonkey(v.Index(i), fmt.Sprintf("%s[%d]", path, i), visiting)
+			if err != nil {
+				return nil, err
+			}
+			elements[i] = element
+		}
+		return &object.Array{Elements: elements}, nil
+
+	case reflect.Map:
+		if v.IsNil() {
+			return vm.Null, nil
+		}
+		leave, err := enter(v, path, visiting)
+		if err != nil {
+			return nil, err
+		}
+		defer leave()
+
+		pairs := make(map[object.HashKey]object.HashPair, v.Len())
+		iter := v.MapRange()
+		for iter.Next() {
+			key, err := toMonkey(iter.Key(), path, visiting)
+			if err != nil {
+				return nil, err
+			}
+			hashable, ok := key.(object.Hashable)
+			if !ok {
+				return nil, conversionError(path, "unusable as hash key: %s", key.Type())
+			}
+
+			value, err := toMonkey(iter.Value(), fmt.Sprintf("%s[%s]", path, key.Inspect()), visiting)
+			if err != nil {
+				return nil, err
+			}
+			pairs[hashable.HashKey()] = object.HashPair{Key: key, Value: value}
+		}
+		return &object.Hash{Pairs: pairs}, nil
+
+	case reflect.Struct:
+		pairs := make(map[object.HashKey]object.HashPair)
+		for _, field := range structFields(v.Type()) {
+			value, err := toMonkey(v.FieldByIndex(field.index), path+"."+field.name, visiting)
+			if err != nil {
+				return nil, err
+			}
+			key := &object.String{Value: field.name}
+			pairs[key.HashKey()] = object.HashPair{Key: key, Value: value}
+		}
+		return &object.Hash{Pairs: pairs}, nil
+
+	case reflect.Func:
+		if v.IsNil() {
+			return vm.Null, nil
+		}
+		builtin, _, err := bindFunc(v)
+		if err != nil {
+			return nil, conversionError(path, "%s", err)
+		}
+		return builtin, nil
+
+	default:
+		return nil, conversionError(path, "cannot convert %s to a Monkey value", v.Type())
+	}
+}
+
+// FromMonkey stores the Go equivalent of o in the value target points to.
+// An interface{} target receives int64, *big.Int, float64, string, bool,
+// nil, []interface{} or map[string]interface{}, or the object itself for
+// functions. Hashes with keys other than strings become
+// map[interface{}]interface{}.
+func FromMonkey(o object.Object, target interface{}) error {
+	v := reflect.ValueOf(target)
+	if v.Kind() != reflect.Pointer || v.IsNil() {
+		return fmt.Errorf("target must be a non-nil pointer, got %T", target)
+	}
+	return fromMonkey(o, v.Elem(), "")
+}
+
+func fromMonkey(o object.Object, v reflect.Value, path string) error {
+	if v.Type().Implements(objectType) && reflect.TypeOf(o).AssignableTo(v.Type()) {
+		v.Set(reflect.ValueOf(o))
+		return nil
+	}
+
+	if v.Type() == bigIntType {
+		integer, ok := compilerObject.ToBig(o)
+		if !ok {
+			return mismatch(path, o, v.Type())
+		}
+		v.Set(reflect.ValueOf(integer))
+		return nil
+	}
+
+	if _, ok := o.(*object.Null); ok {
+		switch v.Kind() {
+		case reflect.Pointer, reflect.Interface, reflect.Slice, reflect.Map:
+			v.Set(reflect.Zero(v.Type()))
+			return nil
+		}
+	}
+
+	switch v.Kind() {
+	case reflect.Interface:
+		if v.NumMethod() > 0 {
+			return mismatch(path, o, v.Type())
+		}
+		value, err := natural(o, path)
+		if err != nil {
+			return err
+		}
+		if value == nil {
+			v.Set(reflect.Zero(v.Type()))
+			return nil
+		}
+		v.Set(reflect.ValueOf(value))
+		return nil
+
+	case reflect.Bool:
+		boolean, ok := o.(*object.Boolean)
+		if !ok {
+			return mismatch(path, o, v.Type())
+		}
+		v.SetBool(boolean.Value)
+		return nil
+
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		integer, ok := o.(*object.Integer)
+		if !ok {
+			return mismatch(path, o, v.Type())
+		}
+		if v.OverflowInt(integer.Value) {
+			return conversionError(path, "%d overflows %s", integer.Value, v.Type())
+		}
+		v.SetInt(integer.Value)
+		return nil
+
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		integer, ok := compilerObject.ToBig(o)
+		if !ok {
+			return mismatch(path, o, v.Type())
+		}
+		if integer.Sign() < 0 || !integer.IsUint64() || v.OverflowUint(integer.Uint64()) {
+			return conversionError(path, "%s overflows %s", integer, v.Type())
+		}
+		v.SetUint(integer.Uint64())
+		return nil
+
+	case reflect.Float32, reflect.Float64:
+		switch number := o.(type) {
+		case *compilerObject.Float:
+			v.SetFloat(number.Value)
+		case *object.Integer:
+			v.SetFloat(float64(number.Value))
+		default:
+			return mismatch(path, o, v.Type())
+		}
+		return nil
+
+	case reflect.String:
+		str, ok := o.(*object.String)
+		if !ok {
+			return mismatch(path, o, v.Type())
+		}
+		v.SetString(str.Value)
+		return nil
+
+	case reflect.Pointer:
+		elem := reflect.New(v.Type().Elem())
+		err := fromMonkey(o, elem.Elem(), path)
+		if err != nil {
+			return err
+		}
+		v.Set(elem)
+		return nil
+
+	case reflect.Slice:
+		array, ok := o.(*object.Array)
+		if !ok {
+			return mismatch(path, o, v.Type())
+		}
+		slice := reflect.MakeSlice(v.Type(), len(array.Elements), len(array.Elements))
+		for i, element := range array.Elements {
+			err := fromMonkey(element, slice.Index(i), fmt.Sprintf("%s[%d]", path, i))
+			if err != nil {
+				return err
+			}
+		}
+		v.Set(slice)
+		return nil
+
+	case reflect.Array:
+		array, ok := o.(*object.Array)
+		if !ok {
+			return mismatch(path, o, v.Type())
+		}
+		if len(array.Elements) != v.Len() {
+			return conversionError(path, "cannot convert array of length %d to %s",
+				len(array.Elements), v.Type())
+		}
+		for i, element := range array.Elements {
+			err := fromMonkey(element, v.Index(i), fmt.Sprintf("%s[%d]", path, i))
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+
+	case reflect.Map:
+		hash, ok := o.(*object.Hash)
+		if !ok {
+			return mismatch(path, o, v.Type())
+		}
+		m := reflect.MakeMapWithSize(v.Type(), len(hash.Pairs))
+		for _, pair := range hash.Pairs {
+			key := reflect.New(v.Type().Key()).Elem()
+			err := fromMonkey(pair.Key, key, path)
+			if err != nil {
+				return err
+			}
+			value := reflect.New(v.Type().Elem()).Elem()
+			err = fromMonkey(pair.Value, value, fmt.Sprintf("%s[%s]", path, pair.Key.Inspect()))
+			if err != nil {
+				return err
+			}
+			m.SetMapIndex(key, value)
+		}
+		v.Set(m)
+		return nil
+
+	case reflect.Struct:
+		hash, ok := o.(*object.Hash)
+		if !ok {
+			return mismatch(path, o, v.Type())
+		}
+		for _, field := range structFields(v.Type()) {
+			key := &object.String{Value: field.name}
+			pair, ok := hash.Pairs[key.HashKey()]
+			if !ok {
+				continue
+			}
+			err := fromMonkey(pair.Value, v.FieldByIndex(field.index), path+"."+field.name)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+
+	default:
+		return conversionError(path, "cannot convert to %s", v.Type())
+	}
+}
+
+// natural returns the Go value an interface{} target receives for o.
+func natural(o object.Object, path string) (interface{}, error) {
+	switch o := o.(type) {
+	case *object.Null:
+		return nil, nil
+	case *object.Boolean:
+		return o.Value, nil
+	case *object.Integer:
+		return o.Value, nil
+	case *compilerObject.BigInteger:
+		return new(big.Int).Set(o.Value), nil
+	case *compilerObject.Float:
+		return o.Value, nil
+	case *object.String:
+		return o.Value, nil
+
+	case *object.Array:
+		elements := make([]interface{}, len(o.Elements))
+		err := fromMonkey(o, reflect.ValueOf(&elements).Elem(), path)
+		return elements, err
+
+	case *object.Hash:
+		for _, pair := range o.Pairs {
+			if _, ok := pair.Key.(*object.String); !ok {
+				m := map[interface{}]interface{}{}
+				err := fromMonkey(o, reflect.ValueOf(&m).Elem(), path)
+				return m, err
+			}
+		}
+		m := map[string]interface{}{}
+		err := fromMonkey(o, reflect.ValueOf(&m).Elem(), path)
+		return m, err
+
+	default:
+		return o, nil
+	}
+}
+
+type structField struct {
+	name  string
+	index []int
+}
+
+func structFields(t reflect.Type) []structField {
+	var fields []structField
+	for _, field := range reflect.VisibleFields(t) {
+		if !field.IsExported() || field.Anonymous {
+			continue
+		}
+
+		name := field.Name
+		if tag, ok := field.Tag.Lookup("monkey"); ok {
+			tag, _, _ = strings.Cut(tag, ",")
+			if tag == "-" {
+				continue
+			}
+			if tag != "" {
+				name = tag
+			}
+		}
+
+		fields = append(fields, structField{name: name, index: field.Index})
+	}
+	return fields
+}
+
+func mismatch(path string, o object.Object, t reflect.Type) error {
+	return conversionError(path, "cannot convert %s to %s", o.Type(), t)
+}
+
+// enter marks the pointer, map or slice v at path as being converted, and
+// returns the function that unmarks it once its conversion is done. Values
+// shared without a cycle are converted once per reference.
+func enter(v reflect.Value, path string, visiting map[visit]string) (func(), error) {
+	key := visit{pointer: v.Pointer(), typ: v.Type()}
+	if v.Kind() == reflect.Slice {
+		key.length = v.Len()
+	}
+
+	if outer, ok := visiting[key]; ok {
+		outer = strings.TrimPrefix(outer, ".")
+		if outer == "" {
+			outer = "the root value"
+		}
+		return nil, conversionError(path, "cyclic reference to %s", outer)
+	}
+
+	visiting[key] = path
+	return func() { delete(visiting, key) }, nil
+}
+
+func conversionError(path string, format string, a ...interface{}) error {
+	message := fmt.Sprintf(format, a...)
+	path = strings.TrimPrefix(path, ".")
+	if path == "" {
+		return fmt.Errorf("%s", message)
+	}
+	return fmt.Errorf("%s: %s", path, message)
+}
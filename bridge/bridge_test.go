@@ -0,0 +1,391 @@
+package bridge
+
+import (
+	"errors"
+	"github.com/carmooo/monkey_compiler/engine"
+	compilerObject "github.com/carmooo/monkey_compiler/object"
+	"github.com/carmooo/monkey_compiler/vm"
+	"github.com/carmooo/monkey_interpreter/object"
+	"math"
+	"math/big"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type address struct {
+	City string `monkey:"city"`
+	Zip  *int   `monkey:"zip"`
+}
+
+type person struct {
+	Name     string   `monkey:"name"`
+	Age      int      `monkey:"age"`
+	Tags     []string `monkey:"tags"`
+	Address  address  `monkey:"address"`
+	Password string   `monkey:"-"`
+	Score    float64
+	private  int
+}
+
+func TestToMonkey(t *testing.T) {
+	zip := 1234
+
+	tests := []struct {
+		input    interface{}
+		expected string
+	}{
+		{nil, "null"},
+		{true, "true"},
+		{42, "42"},
+		{int8(-3), "-3"},
+		{uint64(math.MaxUint64), "18446744073709551615"},
+		{2.5, "2.5"},
+		{"monkey", "monkey"},
+		{big.NewInt(7), "7"},
+		{[]int{1, 2, 3}, "[1, 2, 3]"},
+		{[2]bool{true, false}, "[true, false]"},
+		{[]interface{}{1, "a", nil}, "[1, a, null]"},
+		{map[string]int{"a": 1}, "{a: 1}"},
+		{map[int][]string{1: {"x"}}, "{1: [x]}"},
+		{&zip, "1234"},
+		{(*int)(nil), "null"},
+		{address{City: "Lisbon"}, "{city: Lisbon, zip: null}"},
+		{&object.Integer{Value: 9}, "9"},
+	}
+
+	for _, tt := range tests {
+		result, err := ToMonkey(tt.input)
+		if err != nil {
+			t.Fatalf("conversion error for %#v: %s", tt.input, err)
+		}
+		if result.Inspect() != tt.expected && !sameHash(result, tt.expected) {
+			t.Errorf("wrong conversion of %#v. want=%s, got=%s", tt.input, tt.expected, result.Inspect())
+		}
+	}
+
+	result, err := ToMonkey(nil)
+	if err != nil || result != vm.Null {
+		t.Errorf("nil does not convert to the null singleton. got=%v (%v)", result, err)
+	}
+}
+
+func TestToMonkeyStruct(t *testing.T) {
+	zip := 1000
+	result, err := ToMonkey(person{
+		Name:     "Ada",
+		Age:      36,
+		Tags:     []string{"math"},
+		Address:  address{City: "London", Zip: &zip},
+		Password: "secret",
+		Score:    1.5,
+		private:  1,
+	})
+	if err != nil {
+		t.Fatalf("conversion error: %s", err)
+	}
+
+	hash, ok := result.(*object.Hash)
+	if !ok {
+		t.Fatalf("result is not a hash. got=%T", result)
+	}
+
+	expected := map[string]string{
+		"name":    "Ada",
+		"age":     "36",
+		"tags":    "[math]",
+		"address": "",
+		"Score":   "1.5",
+	}
+	if len(hash.Pairs) != len(expected) {
+		t.Errorf("wrong number of fields. want=%d, got=%d (%s)",
+			len(expected), len(hash.Pairs), hash.Inspect())
+	}
+
+	for name, value := range expected {
+		pair, ok := hash.Pairs[(&object.String{Value: name}).HashKey()]
+		if !ok {
+			t.Errorf("missing field %s", name)
+			continue
+		}
+		if value != "" && pair.Value.Inspect() != value {
+			t.Errorf("wrong value for %s. want=%s, got=%s", name, value, pair.Value.Inspect())
+		}
+	}
+}
+
+func TestFromMonkey(t *testing.T) {
+	e := engine.New(engine.Options{})
+
+	value, err := e.Eval(`{
+		"name": "Ada",
+		"age": 36,
+		"tags": ["math", "engines"],
+		"address": {"city": "London", "zip": 1000},
+		"Password": "ignored",
+		"Score": 3,
+		"unknown": true
+	}`)
+	if err != nil {
+		t.Fatalf("eval error: %s", err)
+	}
+
+	var p person
+	err = FromMonkey(value, &p)
+	if err != nil {
+		t.Fatalf("conversion error: %s", err)
+	}
+
+	zip := 1000
+	expected := person{
+		Name:    "Ada",
+		Age:     36,
+		Tags:    []string{"math", "engines"},
+		Address: address{City: "London", Zip: &zip},
+		Score:   3,
+	}
+	if !reflect.DeepEqual(p, expected) {
+		t.Errorf("wrong struct. want=%+v, got=%+v", expected, p)
+	}
+
+	var generic interface{}
+	value, err = e.Eval(`[1, "two", float("3.5"), true, if (false) { 1 }, {"a": [1]}, {1: 2}, 9223372036854775807 + 1]`)
+	if err != nil {
+		t.Fatalf("eval error: %s", err)
+	}
+	err = FromMonkey(value, &generic)
+	if err != nil {
+		t.Fatalf("conversion error: %s", err)
+	}
+
+	huge, _ := new(big.Int).SetString("9223372036854775808", 10)
+	expectedGeneric := []interface{}{
+		int64(1), "two", 3.5, true, nil,
+		map[string]interface{}{"a": []interface{}{int64(1)}},
+		map[interface{}]interface{}{int64(1): int64(2)},
+		huge,
+	}
+	if !reflect.DeepEqual(generic, expectedGeneric) {
+		t.Errorf("wrong value. want=%#v, got=%#v", expectedGeneric, generic)
+	}
+
+	var counts map[string]uint8
+	value, _ = e.Eval(`{"a": 1, "b": 255}`)
+	err = FromMonkey(value, &counts)
+	if err != nil {
+		t.Fatalf("conversion error: %s", err)
+	}
+	if !reflect.DeepEqual(counts, map[string]uint8{"a": 1, "b": 255}) {
+		t.Errorf("wrong map. got=%v", counts)
+	}
+
+	var fn object.Object
+	value, _ = e.Eval(`fn(x) { x }`)
+	err = FromMonkey(value, &fn)
+	if err != nil || fn != value {
+		t.Errorf("object target does not receive the object itself. got=%v (%v)", fn, err)
+	}
+}
+
+func TestConversionErrors(t *testing.T) {
+	e := engine.New(engine.Options{})
+
+	tests := []struct {
+		input         string
+		target        interface{}
+		expectedError string
+	}{
+		{`"a"`, new(int), "cannot convert STRING to int"},
+		{`300`, new(int8), "300 overflows int8"},
+		{`-1`, new(uint), "-1 overflows uint"},
+		{`[1, "a"]`, new([]int), "[1]: cannot convert STRING to int"},
+		{`[1, 2, 3]`, new([2]int), "cannot convert array of length 3 to [2]int"},
+		{`{"address": {"city": 1}}`, new(person), "address.city: cannot convert INTEGER to string"},
+		{`{"tags": "math"}`, new(person), "tags: cannot convert STRING to []string"},
+		{`1`, new(error), "cannot convert INTEGER to error"},
+		{`1`, new(chan int), "cannot convert to chan int"},
+	}
+
+	for _, tt := range tests {
+		value, err := e.Eval(tt.input)
+		if err != nil {
+			t.Fatalf("eval error: %s", err)
+		}
+
+		err = FromMonkey(value, tt.target)
+		if err == nil {
+			t.Errorf("expected conversion error for %s but resulted in none", tt.input)
+			continue
+		}
+		if err.Error() != tt.expectedError {
+			t.Errorf("wrong error. want=%q, got=%q", tt.expectedError, err)
+		}
+	}
+
+	err := FromMonkey(vm.Null, person{})
+	if err == nil || err.Error() != "target must be a non-nil pointer, got bridge.person" {
+		t.Errorf("wrong error for non-pointer target. got=%v", err)
+	}
+
+	toTests := []struct {
+		input         interface{}
+		expectedError string
+	}{
+		{make(chan int), "cannot convert chan int to a Monkey value"},
+		{map[string]interface{}{"a": []interface{}{complex(1, 2)}}, "[a][0]: cannot convert complex128 to a Monkey value"},
+		{struct{ F func(...int) }{func(...int) {}}, "F: cannot bind func(...int): variadic functions are not supported"},
+	}
+
+	for _, tt := range toTests {
+		_, err := ToMonkey(tt.input)
+		if err == nil || err.Error() != tt.expectedError {
+			t.Errorf("wrong error. want=%q, got=%v", tt.expectedError, err)
+		}
+	}
+}
+
+type node struct {
+	Value int
+	Next  *node
+}
+
+func TestToMonkeyCycles(t *testing.T) {
+	loop := &node{Value: 1}
+	loop.Next = &node{Value: 2, Next: loop}
+
+	self := map[string]interface{}{"a": 1}
+	self["self"] = []interface{}{self}
+
+	list := []interface{}{1, nil}
+	list[1] = list
+
+	tests := []struct {
+		input         interface{}
+		expectedError string
+	}{
+		{loop, "Next.Next: cyclic reference to the root value"},
+		{map[string]*node{"head": loop}, "[head].Next.Next: cyclic reference to [head]"},
+		{self, "[self][0]: cyclic reference to the root value"},
+		{list, "[1]: cyclic reference to the root value"},
+	}
+
+	for _, tt := range tests {
+		_, err := ToMonkey(tt.input)
+		if err == nil || err.Error() != tt.expectedError {
+			t.Errorf("wrong error. want=%q, got=%v", tt.expectedError, err)
+		}
+	}
+
+	shared := &[]int{1}
+	prefix := []interface{}{1, 2}
+
+	sharedTests := []struct {
+		input    interface{}
+		expected string
+	}{
+		{[]*[]int{shared, shared}, "[[1], [1]]"},
+		{[]interface{}{shared, []interface{}{shared, shared}}, "[[1], [[1], [1]]]"},
+		{[]interface{}{prefix, prefix[:1]}, "[[1, 2], [1]]"},
+	}
+
+	for _, tt := range sharedTests {
+		result, err := ToMonkey(tt.input)
+		if err != nil {
+			t.Fatalf("shared value reported as a cycle: %s", err)
+		}
+		if result.Inspect() != tt.expected {
+			t.Errorf("wrong conversion of shared value. want=%s, got=%s", tt.expected, result.Inspect())
+		}
+	}
+}
+
+func TestFunc(t *testing.T) {
+	builtins := compilerObject.NewRegistry()
+
+	functions := map[string]interface{}{
+		"add":   func(a, b int) int { return a + b },
+		"greet": func(p person) string { return "hello " + p.Name },
+		"split": strings.Fields,
+		"check": func(n int) (bool, error) {
+			if n < 0 {
+				return false, errors.New("negative number")
+			}
+			return n%2 == 0, nil
+		},
+		"apply": func(caller compilerObject.Caller, fn object.Object, n int) (int, error) {
+			result, err := caller.Call(fn, &object.Integer{Value: int64(n)})
+			if err != nil {
+				return 0, err
+			}
+			var value int
+			err = FromMonkey(result, &value)
+			return value, err
+		},
+		"noop": func() {},
+	}
+	for name, fn := range functions {
+		err := Register(builtins, name, fn)
+		if err != nil {
+			t.Fatalf("register error: %s", err)
+		}
+	}
+
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{`add(1, 2)`, "3"},
+		{`greet({"name": "Ada"})`, "hello Ada"},
+		{`split(" a b  c ")`, "[a, b, c]"},
+		{`check(4)`, "true"},
+		{`check(-1)`, "Error: negative number"},
+		{`apply(fn(x) { x * 10 }, 4)`, "40"},
+		{`apply(fn(x) { "a" }, 4)`, "Error: cannot convert STRING to int"},
+		{`noop()`, "null"},
+		{`add(1)`, "Error: wrong number of arguments. got=1, want=2"},
+		{`add(1, "2")`, "Error: argument 2: cannot convert STRING to int"},
+	}
+
+	e := engine.New(engine.Options{Builtins: builtins})
+
+	for _, tt := range tests {
+		result, err := e.Eval(tt.input)
+		if err != nil {
+			t.Fatalf("eval error for %s: %s", tt.input, err)
+		}
+		if result.Inspect() != tt.expected {
+			t.Errorf("wrong result for %s. want=%s, got=%s", tt.input, tt.expected, result.Inspect())
+		}
+	}
+
+	_, _, err := Func(42)
+	if err == nil || err.Error() != "cannot bind int: not a function" {
+		t.Errorf("wrong error. got=%v", err)
+	}
+
+	_, _, err = Func(func() (int, int) { return 0, 0 })
+	if err == nil || err.Error() != "cannot bind func() (int, int): too many results" {
+		t.Errorf("wrong error. got=%v", err)
+	}
+}
+
+// sameHash compares hashes by their pairs, since Inspect of a hash with
+// several pairs depends on map order.
+func sameHash(o object.Object, expected string) bool {
+	hash, ok := o.(*object.Hash)
+	if !ok {
+		return false
+	}
+
+	inner := strings.TrimSuffix(strings.TrimPrefix(expected, "{"), "}")
+	parts := strings.Split(inner, ", ")
+	if len(parts) != len(hash.Pairs) {
+		return false
+	}
+	for _, part := range parts {
+		if !strings.Contains(hash.Inspect(), part) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,99 @@
+package bridge
+
+import (
+	"fmt"
+	compilerObject "github.com/carmooo/monkey_compiler/object"
+	"github.com/carmooo/monkey_interpreter/object"
+	"reflect"
+)
+
+// Func binds a Go function as a builtin. Its arguments are converted with
+// FromMonkey and its result with ToMonkey. The function may take a
+// compilerObject.Caller as its first parameter to call the Monkey
+// functions it is given, and may return a value, an error, or both.
+// Arguments that cannot be converted and errors returned by the function
+// become error values, like the ones the default builtins return. Func
+// also returns the arity of the builtin, which excludes the Caller.
+func Func(fn interface{}) (*compilerObject.HostBuiltin, int, error) {
+	v := reflect.ValueOf(fn)
+	if v.Kind() != reflect.Func || v.IsNil() {
+		return nil, 0, fmt.Errorf("cannot bind %T: not a function", fn)
+	}
+	return bindFunc(v)
+}
+
+// Register binds fn with Func and registers it under name.
+func Register(registry *compilerObject.Registry, name string, fn interface{}) error {
+	builtin, arity, err := Func(fn)
+	if err != nil {
+		return err
+	}
+	return registry.RegisterHost(name, arity, builtin.Fn)
+}
+
+func bindFunc(v reflect.Value) (*compilerObject.HostBuiltin, int, error) {
+	t := v.Type()
+	if t.IsVariadic() {
+		return nil, 0, fmt.Errorf("cannot bind %s: variadic functions are not supported", t)
+	}
+
+	first := 0
+	if t.NumIn() > 0 && t.In(0) == callerType {
+		first = 1
+	}
+
+	returnsError := t.NumOut() > 0 && t.Out(t.NumOut()-1) == errorType
+	numValues := t.NumOut()
+	if returnsError {
+		numValues--
+	}
+	if numValues > 1 {
+		return nil, 0, fmt.Errorf("cannot bind %s: too many results", t)
+	}
+
+	arity := t.NumIn() - first
+
+	builtin := &compilerObject.HostBuiltin{
+		Fn: func(caller compilerObject.Caller, args ...object.Object) (object.Object, error) {
+			if len(args) != arity {
+				return newError("wrong number of arguments. got=%d, want=%d", len(args), arity), nil
+			}
+
+			in := make([]reflect.Value, t.NumIn())
+			if first == 1 {
+				in[0] = reflect.ValueOf(&caller).Elem()
+			}
+			for i, arg := range args {
+				value := reflect.New(t.In(first + i)).Elem()
+				err := fromMonkey(arg, value, "")
+				if err != nil {
+					return newError("argument %d: %s", i+1, err), nil
+				}
+				in[first+i] = value
+			}
+
+			out := v.Call(in)
+
+			if returnsError {
+				if err := out[len(out)-1]; !err.IsNil() {
+					return newError("%s", err.Interface().(error)), nil
+				}
+			}
+			if numValues == 0 {
+				return nil, nil
+			}
+
+			result, err := toMonkey(out[0], "", map[visit]string{})
+			if err != nil {
+				return newError("result: %s", err), nil
+			}
+			return result, nil
+		},
+	}
+
+	return builtin, arity, nil
+}
+
+func newError(format string, a ...interface{}) *object.Error {
+	return &object.Error{Message: fmt.Sprintf(format, a...)}
+}
@@ -95,3 +95,14 @@ func TestReadOperands(t *testing.T) {
 		}
 	}
 }
+
+func TestDefinitionsAreContiguous(t *testing.T) {
+	defined := 0
+	for _, ok := definitions[Opcode(defined)]; ok; _, ok = definitions[Opcode(defined)] {
+		defined++
+	}
+
+	if defined != len(definitions) {
+		t.Fatalf("opcode %d has no definition", defined)
+	}
+}
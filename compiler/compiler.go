@@ -2,13 +2,15 @@ package compiler
 
 import (
 	"fmt"
+	"github.com/carmooo/monkey_compiler/ast"
 	"github.com/carmooo/monkey_compiler/code"
 	compilerObject "github.com/carmooo/monkey_compiler/object"
-	"github.com/carmooo/monkey_interpreter/ast"
 	"github.com/carmooo/monkey_interpreter/object"
 	"sort"
 )
 
+var defaultBuiltins = compilerObject.NewRegistry()
+
 type Compiler struct {
 	constants []object.Object
 
@@ -16,6 +18,20 @@ type Compiler struct {
 
 	scopes     []CompilationScope
 	scopeIndex int
+
+	errors CompileErrors
+
+	// the global table of the main program, which owns the import caches
+	mainSymbolTable *SymbolTable
+
+	importer    Importer
+	module      string
+	importStack []string
+
+	allowExternals bool
+
+	// number of hidden symbols defined to hold the state of tries
+	tryTemporaries int
 }
 
 type EmittedInstruction struct {
@@ -27,6 +43,23 @@ type CompilationScope struct {
 	instructions        code.Instructions
 	lastInstruction     EmittedInstruction
 	previousInstruction EmittedInstruction
+
+	// set for the scopes of function literals, as opposed to the main
+	// program and modules
+	function bool
+	// set once the function yields, which makes it a generator
+	yields bool
+	// loops being compiled in this scope, innermost last
+	loops []*loopContext
+	// tries whose body or catch is being compiled in this scope, innermost
+	// last
+	tries []*tryContext
+	// the exception table of the scope, innermost first. Depths are filled
+	// in by scopeHandlers once the instructions are complete.
+	handlers []tryHandler
+	// number of operands being compiled whose enclosing expression has
+	// values on the stack
+	operands int
 }
 
 func New() *Compiler {
@@ -37,9 +70,7 @@ func New() *Compiler {
 	}
 
 	symbolTable := NewSymbolTable()
-	for i, builtin := range object.Builtins {
-		symbolTable.DefineBuiltin(i, builtin.Name)
-	}
+	symbolTable.DefineBuiltins(defaultBuiltins)
 
 	return &Compiler{
 		constants: []object.Object{},
@@ -48,58 +79,104 @@ func New() *Compiler {
 
 		scopes:     []CompilationScope{mainScope},
 		scopeIndex: 0,
+
+		mainSymbolTable: symbolTable,
 	}
 }
 
+// NewWithBuiltins creates a compiler that resolves builtins against the
+// registry instead of the default builtins. The VM running the bytecode
+// must use the same registry.
+func NewWithBuiltins(builtins *compilerObject.Registry) *Compiler {
+	symbolTable := NewSymbolTable()
+	symbolTable.DefineBuiltins(builtins)
+
+	return NewWithState([]object.Object{}, symbolTable)
+}
+
+// NewWithState continues compiling against the constants and symbol table
+// of an earlier compilation. The table remembers the modules already
+// compiled into those constants, so both must be kept together.
 func NewWithState(constants []object.Object, symbolTable *SymbolTable) *Compiler {
 	compiler := New()
 	compiler.constants = constants
 	compiler.symbolTable = symbolTable
+	compiler.mainSymbolTable = symbolTable
 
 	return compiler
 }
 
+// Compile compiles node and keeps going past recoverable errors, such as
+// undefined variables or unknown operators, emitting placeholder
+// instructions in their place. All errors are reported together as
+// CompileErrors and the compiler refuses to produce ByteCode afterwards.
 func (c *Compiler) Compile(node ast.Node) error {
+	err := c.compile(node)
+	if err != nil {
+		return err
+	}
+
+	if len(c.errors) > 0 {
+		return c.errors
+	}
+	return nil
+}
+
+func (c *Compiler) compile(node ast.Node) error {
 	switch node := node.(type) {
 
 	case *ast.Program:
 		for _, s := range node.Statements {
-			err := c.Compile(s)
+			err := c.compile(s)
 			if err != nil {
 				return err
 			}
 		}
 
 	case *ast.ExpressionStatement:
-		err := c.Compile(node.Expression)
+		err := c.compile(node.Expression)
 		if err != nil {
 			return err
 		}
 		c.emit(code.OpPop)
 
 	case *ast.InfixExpression:
-		if node.Operator == "<" {
-			err := c.Compile(node.Right)
+		switch node.Operator {
+		case "<", "<=":
+			err := c.compileOperand(node.Right)
 			if err != nil {
 				return err
 			}
 
-			err = c.Compile(node.Left)
+			err = c.compileOperand(node.Left)
 			if err != nil {
 				return err
 			}
 
-			c.emit(code.OpGreaterThan)
+			if node.Operator == "<" {
+				c.emit(code.OpGreaterThan)
+			} else {
+				c.emit(code.OpGreaterThanOrEqual)
+			}
 
 			return nil
+
+		case "&&":
+			return c.compileAnd(node)
+
+		case "||":
+			return c.compileOr(node)
+
+		case "=", "+=", "-=", "*=", "/=":
+			return c.compileAssignment(node)
 		}
 
-		err := c.Compile(node.Left)
+		err := c.compileOperand(node.Left)
 		if err != nil {
 			return err
 		}
 
-		err = c.Compile(node.Right)
+		err = c.compileOperand(node.Right)
 		if err != nil {
 			return err
 		}
@@ -113,18 +190,24 @@ func (c *Compiler) Compile(node ast.Node) error {
 			c.emit(code.OpMul)
 		case "/":
 			c.emit(code.OpDiv)
+		case "%":
+			c.emit(code.OpMod)
 		case "==":
 			c.emit(code.OpEqual)
 		case "!=":
 			c.emit(code.OpNotEqual)
 		case ">":
 			c.emit(code.OpGreaterThan)
+		case ">=":
+			c.emit(code.OpGreaterThanOrEqual)
+		case "in":
+			c.emit(code.OpIn)
 		default:
-			return fmt.Errorf("unknown operator %s", node.Operator)
+			c.addError(node, "unknown operator %s", node.Operator)
 		}
 
 	case *ast.PrefixExpression:
-		err := c.Compile(node.Right)
+		err := c.compile(node.Right)
 		if err != nil {
 			return err
 		}
@@ -135,25 +218,23 @@ func (c *Compiler) Compile(node ast.Node) error {
 		case "!":
 			c.emit(code.OpBang)
 		default:
-			return fmt.Errorf("unknown operator %s", node.Operator)
+			c.addError(node, "unknown operator %s", node.Operator)
 		}
 
 	case *ast.IfExpression:
-		err := c.Compile(node.Condition)
+		err := c.compile(node.Condition)
 		if err != nil {
 			return err
 		}
 
 		jumpNotTruthyPos := c.emit(code.OpJumpNotTruthy, 9999)
 
-		err = c.Compile(node.Consequence)
+		err = c.compile(node.Consequence)
 		if err != nil {
 			return err
 		}
 
-		if c.lastInstructionIs(code.OpPop) {
-			c.removeLastPop()
-		}
+		c.leaveBlockValue()
 
 		jumpPos := c.emit(code.OpJump, 9999)
 
@@ -164,23 +245,30 @@ func (c *Compiler) Compile(node ast.Node) error {
 		if node.Alternative == nil {
 			c.emit(code.OpNull)
 		} else {
-			err = c.Compile(node.Alternative)
+			err = c.compile(node.Alternative)
 			if err != nil {
 				return err
 			}
 
-			if c.lastInstructionIs(code.OpPop) {
-				c.removeLastPop()
-			}
+			c.leaveBlockValue()
 		}
 
 		// back-patching Jump
 		afterAlternativePosition := len(c.currentInstructions())
 		c.changeOperand(jumpPos, afterAlternativePosition)
 
+	case *ast.WhileExpression:
+		return c.compileWhile(node)
+
+	case *ast.ForExpression:
+		return c.compileFor(node)
+
+	case *ast.BreakStatement, *ast.ContinueStatement:
+		return c.compileLoopJump(node.(ast.Statement))
+
 	case *ast.BlockStatement:
 		for _, s := range node.Statements {
-			err := c.Compile(s)
+			err := c.compile(s)
 			if err != nil {
 				return err
 			}
@@ -189,29 +277,35 @@ func (c *Compiler) Compile(node ast.Node) error {
 	case *ast.LetStatement:
 		symbol := c.symbolTable.Define(node.Name.Value)
 
-		err := c.Compile(node.Value)
+		err := c.compile(node.Value)
 		if err != nil {
 			return err
 		}
 
-		if symbol.Scope == GlobalScope {
-			c.emit(code.OpSetGlobal, symbol.Index)
-		} else {
-			c.emit(code.OpSetLocal, symbol.Index)
-		}
+		c.storeSymbol(symbol)
 
 	case *ast.Identifier:
-		symbol, ok := c.symbolTable.Resolve(node.Value)
+		symbol, ok := c.resolve(node.Value)
 		if !ok {
-			return fmt.Errorf("undefined variable: %s", node.Value)
+			c.addError(node, "undefined variable: %s", node.Value)
+			// placeholder so the surrounding code still compiles
+			c.emit(code.OpNull)
+			return nil
 		}
 
 		c.loadSymbol(symbol)
 
 	case *ast.IntegerLiteral:
-		integer := &object.Integer{Value: node.Value}
+		var integer object.Object = &object.Integer{Value: node.Value}
+		if node.Big != nil {
+			integer = &compilerObject.BigInteger{Value: node.Big}
+		}
 		c.emit(code.OpConstant, c.addConstant(integer))
 
+	case *ast.FloatLiteral:
+		float := &compilerObject.Float{Value: node.Value}
+		c.emit(code.OpConstant, c.addConstant(float))
+
 	case *ast.Boolean:
 		if node.Value {
 			c.emit(code.OpTrue)
@@ -225,7 +319,7 @@ func (c *Compiler) Compile(node ast.Node) error {
 
 	case *ast.ArrayLiteral:
 		for _, el := range node.Elements {
-			err := c.Compile(el)
+			err := c.compileOperand(el)
 			if err != nil {
 				return err
 			}
@@ -243,11 +337,11 @@ func (c *Compiler) Compile(node ast.Node) error {
 		})
 
 		for _, k := range keys {
-			err := c.Compile(k)
+			err := c.compileOperand(k)
 			if err != nil {
 				return err
 			}
-			err = c.Compile(node.Pairs[k])
+			err = c.compileOperand(node.Pairs[k])
 			if err != nil {
 				return err
 			}
@@ -256,12 +350,12 @@ func (c *Compiler) Compile(node ast.Node) error {
 		c.emit(code.OpHash, len(node.Pairs)*2)
 
 	case *ast.IndexExpression:
-		err := c.Compile(node.Left)
+		err := c.compileOperand(node.Left)
 		if err != nil {
 			return err
 		}
 
-		err = c.Compile(node.Index)
+		err = c.compileOperand(node.Index)
 		if err != nil {
 			return err
 		}
@@ -275,7 +369,7 @@ func (c *Compiler) Compile(node ast.Node) error {
 			c.symbolTable.Define(p.Value)
 		}
 
-		err := c.Compile(node.Body)
+		err := c.compile(node.Body)
 		if err != nil {
 			return err
 		}
@@ -290,36 +384,62 @@ func (c *Compiler) Compile(node ast.Node) error {
 
 		freeSymbols := c.symbolTable.FreeSymbols
 		numLocals := c.symbolTable.numDefinitions
+		generator := c.scopes[c.scopeIndex].yields
+		handlers := c.scopeHandlers()
 		fnInstructions := c.leaveScope()
 
 		for _, s := range freeSymbols {
-			c.loadSymbol(s)
+			c.captureSymbol(s)
 		}
 
 		fn := &compilerObject.CompiledFunction{
 			Instructions:  fnInstructions,
 			NumLocals:     numLocals,
 			NumParameters: len(node.Parameters),
+			Generator:     generator,
+			Handlers:      handlers,
 		}
 
 		c.emit(code.OpClosure, c.addConstant(fn), len(freeSymbols))
 
 	case *ast.ReturnStatement:
-		err := c.Compile(node.Value)
+		if c.module != "" && !c.scopes[c.scopeIndex].function {
+			c.addError(node, "return outside a function in a module")
+		}
+
+		err := c.compile(node.Value)
+		if err != nil {
+			return err
+		}
+
+		err = c.leaveTries(0)
 		if err != nil {
 			return err
 		}
 
 		c.emit(code.OpReturnValue)
 
+	case *ast.ImportExpression:
+		return c.compileImport(node)
+
+	case *ast.ThrowExpression:
+		return c.compileThrow(node)
+
+	case *ast.TryExpression:
+		return c.compileTry(node)
+
 	case *ast.CallExpression:
-		err := c.Compile(node.Function)
+		if c.isIntrinsic(node, "yield") {
+			return c.compileYield(node)
+		}
+
+		err := c.compileOperand(node.Function)
 		if err != nil {
 			return err
 		}
 
 		for _, arg := range node.Arguments {
-			err := c.Compile(arg)
+			err := c.compileOperand(arg)
 			if err != nil {
 				return err
 			}
@@ -331,16 +451,197 @@ func (c *Compiler) Compile(node ast.Node) error {
 	return nil
 }
 
+// compileAnd short-circuits: the right operand is only evaluated when the
+// left one is truthy. The result is always a boolean.
+func (c *Compiler) compileAnd(node *ast.InfixExpression) error {
+	err := c.compile(node.Left)
+	if err != nil {
+		return err
+	}
+
+	leftNotTruthyPos := c.emit(code.OpJumpNotTruthy, 9999)
+
+	err = c.compile(node.Right)
+	if err != nil {
+		return err
+	}
+
+	rightNotTruthyPos := c.emit(code.OpJumpNotTruthy, 9999)
+
+	c.emit(code.OpTrue)
+	jumpPos := c.emit(code.OpJump, 9999)
+
+	falsePosition := len(c.currentInstructions())
+	c.changeOperand(leftNotTruthyPos, falsePosition)
+	c.changeOperand(rightNotTruthyPos, falsePosition)
+
+	c.emit(code.OpFalse)
+
+	c.changeOperand(jumpPos, len(c.currentInstructions()))
+
+	return nil
+}
+
+// compileOr short-circuits: the right operand is only evaluated when the
+// left one is not truthy. The result is always a boolean.
+func (c *Compiler) compileOr(node *ast.InfixExpression) error {
+	err := c.compile(node.Left)
+	if err != nil {
+		return err
+	}
+
+	leftNotTruthyPos := c.emit(code.OpJumpNotTruthy, 9999)
+
+	c.emit(code.OpTrue)
+	leftTruthyJumpPos := c.emit(code.OpJump, 9999)
+
+	c.changeOperand(leftNotTruthyPos, len(c.currentInstructions()))
+
+	err = c.compile(node.Right)
+	if err != nil {
+		return err
+	}
+
+	rightNotTruthyPos := c.emit(code.OpJumpNotTruthy, 9999)
+
+	c.emit(code.OpTrue)
+	rightTruthyJumpPos := c.emit(code.OpJump, 9999)
+
+	c.changeOperand(rightNotTruthyPos, len(c.currentInstructions()))
+
+	c.emit(code.OpFalse)
+
+	afterOrPosition := len(c.currentInstructions())
+	c.changeOperand(leftTruthyJumpPos, afterOrPosition)
+	c.changeOperand(rightTruthyJumpPos, afterOrPosition)
+
+	return nil
+}
+
+var compoundAssignmentOperators = map[string]code.Opcode{
+	"+=": code.OpAdd,
+	"-=": code.OpSub,
+	"*=": code.OpMul,
+	"/=": code.OpDiv,
+}
+
+// compileAssignment stores into an existing binding and leaves the
+// assigned value on the stack as the result of the expression.
+func (c *Compiler) compileAssignment(node *ast.InfixExpression) error {
+	if index, ok := node.Left.(*ast.IndexExpression); ok {
+		return c.compileIndexAssignment(node, index)
+	}
+
+	ident, ok := node.Left.(*ast.Identifier)
+	if !ok {
+		c.addError(node, "invalid assignment target: %s", node.Left.String())
+		return nil
+	}
+
+	symbol, ok := c.resolve(ident.Value)
+	if !ok {
+		c.addError(node, "undefined variable: %s", ident.Value)
+		c.emit(code.OpNull)
+		return nil
+	}
+	if symbol.Scope == BuiltInScope {
+		c.addError(node, "cannot assign to builtin: %s", ident.Value)
+		c.emit(code.OpNull)
+		return nil
+	}
+
+	if op, ok := compoundAssignmentOperators[node.Operator]; ok {
+		c.loadSymbol(symbol)
+
+		err := c.compileOperand(node.Right)
+		if err != nil {
+			return err
+		}
+
+		c.emit(op)
+	} else {
+		err := c.compile(node.Right)
+		if err != nil {
+			return err
+		}
+	}
+
+	c.storeSymbol(symbol)
+	c.loadSymbol(symbol)
+
+	return nil
+}
+
+// compileIndexAssignment emits OpSetIndex, which stores the value into the
+// collection and leaves it on the stack as the result of the expression.
+// A compound assignment duplicates the collection and the index to read the
+// current element, so both are evaluated once.
+func (c *Compiler) compileIndexAssignment(node *ast.InfixExpression, target *ast.IndexExpression) error {
+	err := c.compileOperand(target.Left)
+	if err != nil {
+		return err
+	}
+
+	err = c.compileOperand(target.Index)
+	if err != nil {
+		return err
+	}
+
+	op, compound := compoundAssignmentOperators[node.Operator]
+	if compound {
+		c.emit(code.OpDupPair)
+		c.emit(code.OpIndex)
+	}
+
+	err = c.compileOperand(node.Right)
+	if err != nil {
+		return err
+	}
+
+	if compound {
+		c.emit(op)
+	}
+
+	c.emit(code.OpSetIndex)
+
+	return nil
+}
+
 func (c *Compiler) addConstant(obj object.Object) int {
 	c.constants = append(c.constants, obj)
 	return len(c.constants) - 1
 }
 
+// ByteCode returns nil if compilation reported any errors.
 func (c *Compiler) ByteCode() *ByteCode {
+	if len(c.errors) > 0 {
+		return nil
+	}
+
 	return &ByteCode{
 		Instructions: c.currentInstructions(),
 		Constants:    c.constants,
+		Handlers:     c.scopeHandlers(),
+	}
+}
+
+// addError records an error at node. A finally block is compiled once for
+// every way out of its try, so an error already recorded for the node is
+// dropped.
+func (c *Compiler) addError(node ast.Node, format string, a ...interface{}) {
+	message := fmt.Sprintf(format, a...)
+	for _, err := range c.errors {
+		if err.Node == node && err.Message == message {
+			return
+		}
 	}
+
+	c.errors = append(c.errors, &CompileError{
+		Message:  message,
+		Module:   c.module,
+		Position: node.Pos(),
+		Node:     node,
+	})
 }
 
 func (c *Compiler) emit(op code.Opcode, operands ...int) int {
@@ -357,6 +658,7 @@ func (c *Compiler) enterScope() {
 		instructions:        code.Instructions{},
 		lastInstruction:     EmittedInstruction{},
 		previousInstruction: EmittedInstruction{},
+		function:            true,
 	}
 	c.scopes = append(c.scopes, scope)
 	c.scopeIndex++
@@ -417,6 +719,17 @@ func (c *Compiler) replaceInstruction(pos int, newInstruction []byte) {
 	}
 }
 
+// leaveBlockValue leaves the value of a just compiled block on the stack:
+// the value of its last expression statement, or null for blocks that
+// are empty or end with another kind of statement.
+func (c *Compiler) leaveBlockValue() {
+	if c.lastInstructionIs(code.OpPop) {
+		c.removeLastPop()
+	} else {
+		c.emit(code.OpNull)
+	}
+}
+
 func (c *Compiler) replaceLastPopWithReturn() {
 	c.replaceInstruction(
 		c.scopes[c.scopeIndex].lastInstruction.Position,
@@ -445,7 +758,32 @@ func (c *Compiler) loadSymbol(symbol Symbol) {
 	}
 }
 
+// captureSymbol pushes an upvalue for a free symbol of a closure that is
+// about to be created. Free symbols always resolve to a local or a free
+// variable of the enclosing scope.
+func (c *Compiler) captureSymbol(symbol Symbol) {
+	switch symbol.Scope {
+	case LocalScope:
+		c.emit(code.OpCaptureLocal, symbol.Index)
+	case FreeScope:
+		c.emit(code.OpCaptureFree, symbol.Index)
+	}
+}
+
+func (c *Compiler) storeSymbol(symbol Symbol) {
+	switch symbol.Scope {
+	case GlobalScope:
+		c.emit(code.OpSetGlobal, symbol.Index)
+	case LocalScope:
+		c.emit(code.OpSetLocal, symbol.Index)
+	case FreeScope:
+		c.emit(code.OpSetFree, symbol.Index)
+	}
+}
+
 type ByteCode struct {
 	Instructions code.Instructions
 	Constants    []object.Object
+	// Handlers is the exception table of the main program.
+	Handlers []compilerObject.Handler
 }
@@ -2,12 +2,15 @@ package compiler
 
 import (
 	"fmt"
+	"github.com/carmooo/monkey_compiler/ast"
 	"github.com/carmooo/monkey_compiler/code"
+	"github.com/carmooo/monkey_compiler/lexer"
 	compilerObject "github.com/carmooo/monkey_compiler/object"
-	"github.com/carmooo/monkey_interpreter/ast"
-	"github.com/carmooo/monkey_interpreter/lexer"
+	"github.com/carmooo/monkey_compiler/parser"
 	"github.com/carmooo/monkey_interpreter/object"
-	"github.com/carmooo/monkey_interpreter/parser"
+	"os"
+	"path/filepath"
+	"reflect"
 	"testing"
 )
 
@@ -83,6 +86,32 @@ func TestIntegerArithmetic(t *testing.T) {
 	runCompilerTests(t, tests)
 }
 
+func TestFloatLiterals(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			input:             "1.5 + 2",
+			expectedConstants: []interface{}{1.5, 2},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpAdd),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input:             "-0.25",
+			expectedConstants: []interface{}{0.25},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpMinus),
+				code.Make(code.OpPop),
+			},
+		},
+	}
+
+	runCompilerTests(t, tests)
+}
+
 func TestBooleanExpression(t *testing.T) {
 	tests := []compilerTestCase{
 		{
@@ -175,6 +204,180 @@ func TestBooleanExpression(t *testing.T) {
 	runCompilerTests(t, tests)
 }
 
+func TestAdditionalOperators(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			input: "5 % 2",
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpMod),
+				code.Make(code.OpPop),
+			},
+			expectedConstants: []interface{}{5, 2},
+		},
+		{
+			input: "1 >= 2",
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpGreaterThanOrEqual),
+				code.Make(code.OpPop),
+			},
+			expectedConstants: []interface{}{1, 2},
+		},
+		{
+			input: "1 <= 2",
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpGreaterThanOrEqual),
+				code.Make(code.OpPop),
+			},
+			expectedConstants: []interface{}{2, 1},
+		},
+		{
+			input: `"a" in "abc"`,
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpIn),
+				code.Make(code.OpPop),
+			},
+			expectedConstants: []interface{}{"a", "abc"},
+		},
+		{
+			input: "true && false",
+			expectedInstructions: []code.Instructions{
+				// 0000
+				code.Make(code.OpTrue),
+				// 0001
+				code.Make(code.OpJumpNotTruthy, 12),
+				// 0004
+				code.Make(code.OpFalse),
+				// 0005
+				code.Make(code.OpJumpNotTruthy, 12),
+				// 0008
+				code.Make(code.OpTrue),
+				// 0009
+				code.Make(code.OpJump, 13),
+				// 0012
+				code.Make(code.OpFalse),
+				// 0013
+				code.Make(code.OpPop),
+			},
+			expectedConstants: []interface{}{},
+		},
+		{
+			input: "true || false",
+			expectedInstructions: []code.Instructions{
+				// 0000
+				code.Make(code.OpTrue),
+				// 0001
+				code.Make(code.OpJumpNotTruthy, 8),
+				// 0004
+				code.Make(code.OpTrue),
+				// 0005
+				code.Make(code.OpJump, 17),
+				// 0008
+				code.Make(code.OpFalse),
+				// 0009
+				code.Make(code.OpJumpNotTruthy, 16),
+				// 0012
+				code.Make(code.OpTrue),
+				// 0013
+				code.Make(code.OpJump, 17),
+				// 0016
+				code.Make(code.OpFalse),
+				// 0017
+				code.Make(code.OpPop),
+			},
+			expectedConstants: []interface{}{},
+		},
+	}
+
+	runCompilerTests(t, tests)
+}
+
+func TestLoops(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			input:             `while (true) { 1; break; continue; }`,
+			expectedConstants: []interface{}{1},
+			expectedInstructions: []code.Instructions{
+				// 0000
+				code.Make(code.OpTrue),
+				// 0001
+				code.Make(code.OpJumpNotTruthy, 17),
+				// 0004
+				code.Make(code.OpConstant, 0),
+				// 0007
+				code.Make(code.OpPop),
+				// 0008
+				code.Make(code.OpJump, 17),
+				// 0011
+				code.Make(code.OpJump, 0),
+				// 0014
+				code.Make(code.OpJump, 0),
+				// 0017
+				code.Make(code.OpNull),
+				// 0018
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input:             `for (let i = 0; i < 3; i + 1) { continue }`,
+			expectedConstants: []interface{}{0, 3, 1},
+			expectedInstructions: []code.Instructions{
+				// 0000
+				code.Make(code.OpConstant, 0),
+				// 0003
+				code.Make(code.OpSetGlobal, 0),
+				// 0006
+				code.Make(code.OpConstant, 1),
+				// 0009
+				code.Make(code.OpGetGlobal, 0),
+				// 0012
+				code.Make(code.OpGreaterThan),
+				// 0013
+				code.Make(code.OpJumpNotTruthy, 30),
+				// 0016
+				code.Make(code.OpJump, 19),
+				// 0019
+				code.Make(code.OpGetGlobal, 0),
+				// 0022
+				code.Make(code.OpConstant, 2),
+				// 0025
+				code.Make(code.OpAdd),
+				// 0026
+				code.Make(code.OpPop),
+				// 0027
+				code.Make(code.OpJump, 6),
+				// 0030
+				code.Make(code.OpNull),
+				// 0031
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input:             `for (;;) { break }`,
+			expectedConstants: []interface{}{},
+			expectedInstructions: []code.Instructions{
+				// 0000
+				code.Make(code.OpJump, 6),
+				// 0003
+				code.Make(code.OpJump, 0),
+				// 0006
+				code.Make(code.OpNull),
+				// 0007
+				code.Make(code.OpPop),
+			},
+		},
+	}
+
+	runCompilerTests(t, tests)
+}
+
 func TestConditionals(t *testing.T) {
 	tests := []compilerTestCase{
 		{
@@ -201,6 +404,30 @@ func TestConditionals(t *testing.T) {
 				code.Make(code.OpPop),
 			},
 		},
+		{
+			input: `
+			if (true) { let x = 10; } else { };
+			`,
+			expectedConstants: []interface{}{10},
+			expectedInstructions: []code.Instructions{
+				// 0000
+				code.Make(code.OpTrue),
+				// 0001
+				code.Make(code.OpJumpNotTruthy, 14),
+				// 0004
+				code.Make(code.OpConstant, 0),
+				// 0007
+				code.Make(code.OpSetGlobal, 0),
+				// 0010
+				code.Make(code.OpNull),
+				// 0011
+				code.Make(code.OpJump, 15),
+				// 0014
+				code.Make(code.OpNull),
+				// 0015
+				code.Make(code.OpPop),
+			},
+		},
 		{
 			input: `
 			if (true) { 10 } else { 20 }; 3333;
@@ -317,86 +544,208 @@ func TestGlobalLetStatement(t *testing.T) {
 	runCompilerTests(t, tests)
 }
 
-func TestStringExpressions(t *testing.T) {
+func TestAssignments(t *testing.T) {
 	tests := []compilerTestCase{
 		{
-			input:             `"monkey"`,
-			expectedConstants: []interface{}{"monkey"},
+			input: `let a = 1; let a = 2;`,
 			expectedInstructions: []code.Instructions{
 				code.Make(code.OpConstant, 0),
-				code.Make(code.OpPop),
+				code.Make(code.OpSetGlobal, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpSetGlobal, 0),
 			},
+			expectedConstants: []interface{}{1, 2},
 		},
 		{
-			input:             `"mon" + "key"`,
-			expectedConstants: []interface{}{"mon", "key"},
+			input: `let a = 1; a = 2;`,
 			expectedInstructions: []code.Instructions{
 				code.Make(code.OpConstant, 0),
+				code.Make(code.OpSetGlobal, 0),
 				code.Make(code.OpConstant, 1),
-				code.Make(code.OpAdd),
+				code.Make(code.OpSetGlobal, 0),
+				code.Make(code.OpGetGlobal, 0),
 				code.Make(code.OpPop),
 			},
+			expectedConstants: []interface{}{1, 2},
 		},
-	}
-
-	runCompilerTests(t, tests)
-}
-
-func TestArrayLiterals(t *testing.T) {
-	tests := []compilerTestCase{
 		{
-			input:             "[]",
-			expectedConstants: []interface{}{},
+			input: `fn() { let a = 1; a += 2; }`,
 			expectedInstructions: []code.Instructions{
-				code.Make(code.OpArray, 0),
+				code.Make(code.OpClosure, 2, 0),
 				code.Make(code.OpPop),
 			},
+			expectedConstants: []interface{}{
+				1,
+				2,
+				[]code.Instructions{
+					code.Make(code.OpConstant, 0),
+					code.Make(code.OpSetLocal, 0),
+					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpConstant, 1),
+					code.Make(code.OpAdd),
+					code.Make(code.OpSetLocal, 0),
+					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpReturnValue),
+				},
+			},
 		},
 		{
-			input:             "[1, 2, 3]",
-			expectedConstants: []interface{}{1, 2, 3},
+			input: `let a = [1]; a[0] = 2;`,
 			expectedInstructions: []code.Instructions{
 				code.Make(code.OpConstant, 0),
+				code.Make(code.OpArray, 1),
+				code.Make(code.OpSetGlobal, 0),
+				code.Make(code.OpGetGlobal, 0),
 				code.Make(code.OpConstant, 1),
 				code.Make(code.OpConstant, 2),
-				code.Make(code.OpArray, 3),
+				code.Make(code.OpSetIndex),
 				code.Make(code.OpPop),
 			},
+			expectedConstants: []interface{}{1, 0, 2},
 		},
 		{
-			input:             "[1 + 2, 3 - 4, 5 * 6]",
-			expectedConstants: []interface{}{1, 2, 3, 4, 5, 6},
+			input: `let a = [1]; a[0] += 2;`,
 			expectedInstructions: []code.Instructions{
 				code.Make(code.OpConstant, 0),
+				code.Make(code.OpArray, 1),
+				code.Make(code.OpSetGlobal, 0),
+				code.Make(code.OpGetGlobal, 0),
 				code.Make(code.OpConstant, 1),
-				code.Make(code.OpAdd),
+				code.Make(code.OpDupPair),
+				code.Make(code.OpIndex),
 				code.Make(code.OpConstant, 2),
-				code.Make(code.OpConstant, 3),
-				code.Make(code.OpSub),
-				code.Make(code.OpConstant, 4),
-				code.Make(code.OpConstant, 5),
-				code.Make(code.OpMul),
-				code.Make(code.OpArray, 3),
+				code.Make(code.OpAdd),
+				code.Make(code.OpSetIndex),
+				code.Make(code.OpPop),
+			},
+			expectedConstants: []interface{}{1, 0, 2},
+		},
+		{
+			input: `fn(a) { fn() { a = 1; } }`,
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpClosure, 2, 0),
 				code.Make(code.OpPop),
 			},
+			expectedConstants: []interface{}{
+				1,
+				[]code.Instructions{
+					code.Make(code.OpConstant, 0),
+					code.Make(code.OpSetFree, 0),
+					code.Make(code.OpGetFree, 0),
+					code.Make(code.OpReturnValue),
+				},
+				[]code.Instructions{
+					code.Make(code.OpCaptureLocal, 0),
+					code.Make(code.OpClosure, 1, 1),
+					code.Make(code.OpReturnValue),
+				},
+			},
 		},
 	}
 
 	runCompilerTests(t, tests)
+
+	errorTests := []struct {
+		input         string
+		expectedError string
+	}{
+		{`a = 1`, "1:1: undefined variable: a"},
+		{`len = 1`, "1:1: cannot assign to builtin: len"},
+		{`1 = 1`, "1:1: invalid assignment target: 1"},
+	}
+
+	for _, tt := range errorTests {
+		compiler := New()
+		err := compiler.Compile(parse(tt.input))
+		if err == nil {
+			t.Fatalf("expected compiler error but resulted in none.")
+		}
+		if err.Error() != tt.expectedError {
+			t.Errorf("wrong compiler error. want=%q, got=%q", tt.expectedError, err)
+		}
+	}
 }
 
-func TestHashLiterals(t *testing.T) {
+func TestStringExpressions(t *testing.T) {
 	tests := []compilerTestCase{
 		{
-			input:             "{}",
-			expectedConstants: []interface{}{},
+			input:             `"monkey"`,
+			expectedConstants: []interface{}{"monkey"},
 			expectedInstructions: []code.Instructions{
-				code.Make(code.OpHash, 0),
+				code.Make(code.OpConstant, 0),
 				code.Make(code.OpPop),
 			},
 		},
 		{
-			input:             "{1: 2, 3: 4, 5: 6}",
+			input:             `"mon" + "key"`,
+			expectedConstants: []interface{}{"mon", "key"},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpAdd),
+				code.Make(code.OpPop),
+			},
+		},
+	}
+
+	runCompilerTests(t, tests)
+}
+
+func TestArrayLiterals(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			input:             "[]",
+			expectedConstants: []interface{}{},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpArray, 0),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input:             "[1, 2, 3]",
+			expectedConstants: []interface{}{1, 2, 3},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpConstant, 2),
+				code.Make(code.OpArray, 3),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input:             "[1 + 2, 3 - 4, 5 * 6]",
+			expectedConstants: []interface{}{1, 2, 3, 4, 5, 6},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpAdd),
+				code.Make(code.OpConstant, 2),
+				code.Make(code.OpConstant, 3),
+				code.Make(code.OpSub),
+				code.Make(code.OpConstant, 4),
+				code.Make(code.OpConstant, 5),
+				code.Make(code.OpMul),
+				code.Make(code.OpArray, 3),
+				code.Make(code.OpPop),
+			},
+		},
+	}
+
+	runCompilerTests(t, tests)
+}
+
+func TestHashLiterals(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			input:             "{}",
+			expectedConstants: []interface{}{},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpHash, 0),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input:             "{1: 2, 3: 4, 5: 6}",
 			expectedConstants: []interface{}{1, 2, 3, 4, 5, 6},
 			expectedInstructions: []code.Instructions{
 				code.Make(code.OpConstant, 0),
@@ -821,7 +1170,7 @@ func TestClosures(t *testing.T) {
 					code.Make(code.OpReturnValue),
 				},
 				[]code.Instructions{
-					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpCaptureLocal, 0),
 					code.Make(code.OpClosure, 0, 1),
 					code.Make(code.OpReturnValue),
 				},
@@ -851,13 +1200,13 @@ func TestClosures(t *testing.T) {
 					code.Make(code.OpReturnValue),
 				},
 				[]code.Instructions{
-					code.Make(code.OpGetFree, 0),
-					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpCaptureFree, 0),
+					code.Make(code.OpCaptureLocal, 0),
 					code.Make(code.OpClosure, 0, 2),
 					code.Make(code.OpReturnValue),
 				},
 				[]code.Instructions{
-					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpCaptureLocal, 0),
 					code.Make(code.OpClosure, 1, 1),
 					code.Make(code.OpReturnValue),
 				},
@@ -901,15 +1250,15 @@ func TestClosures(t *testing.T) {
 				[]code.Instructions{
 					code.Make(code.OpConstant, 2),
 					code.Make(code.OpSetLocal, 0),
-					code.Make(code.OpGetFree, 0),
-					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpCaptureFree, 0),
+					code.Make(code.OpCaptureLocal, 0),
 					code.Make(code.OpClosure, 4, 2),
 					code.Make(code.OpReturnValue),
 				},
 				[]code.Instructions{
 					code.Make(code.OpConstant, 1),
 					code.Make(code.OpSetLocal, 0),
-					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpCaptureLocal, 0),
 					code.Make(code.OpClosure, 5, 1),
 					code.Make(code.OpReturnValue),
 				},
@@ -926,6 +1275,610 @@ func TestClosures(t *testing.T) {
 	runCompilerTests(t, tests)
 }
 
+func TestCompileErrors(t *testing.T) {
+	tests := []struct {
+		input          string
+		expectedErrors []string
+	}{
+		{
+			input:          "a",
+			expectedErrors: []string{"1:1: undefined variable: a"},
+		},
+		{
+			input: "let x = a + b; x; c;",
+			expectedErrors: []string{
+				"1:9: undefined variable: a",
+				"1:13: undefined variable: b",
+				"1:19: undefined variable: c",
+			},
+		},
+		{
+			input: "let x = 1;\nlet y = x +\n  z;\n\n  w",
+			expectedErrors: []string{
+				"3:3: undefined variable: z",
+				"5:3: undefined variable: w",
+			},
+		},
+		{
+			input: "fn() { y }; let f = fn(a) { a + z };",
+			expectedErrors: []string{
+				"1:8: undefined variable: y",
+				"1:33: undefined variable: z",
+			},
+		},
+		{
+			// a finally block compiled for every way out of its try reports
+			// its errors once
+			input: "fn() { while (true) { try { if (a) { break }; return 1 } finally { b } } }",
+			expectedErrors: []string{
+				"1:33: undefined variable: a",
+				"1:68: undefined variable: b",
+			},
+		},
+		{
+			input: "yield(1); fn() { yield(1, 2) };",
+			expectedErrors: []string{
+				"1:1: yield outside a function",
+				"1:18: yield expects a single value",
+			},
+		},
+		{
+			input: "break; continue; while (true) { fn() { break } }; for (;;) { 1 + if (true) { continue } }",
+			expectedErrors: []string{
+				"1:1: break outside a loop",
+				"1:8: continue outside a loop",
+				"1:40: break outside a loop",
+				"1:78: continue inside an expression",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		program := parse(tt.input)
+
+		compiler := New()
+		err := compiler.Compile(program)
+		if err == nil {
+			t.Fatalf("expected compiler error but resulted in none.")
+		}
+
+		errs, ok := err.(CompileErrors)
+		if !ok {
+			t.Fatalf("error is not CompileErrors. got=%T (%+v)", err, err)
+		}
+
+		if len(errs) != len(tt.expectedErrors) {
+			t.Fatalf("wrong number of errors. want=%d, got=%d (%s)",
+				len(tt.expectedErrors), len(errs), err)
+		}
+
+		for i, expected := range tt.expectedErrors {
+			if errs[i].Error() != expected {
+				t.Errorf("wrong error at %d. want=%q, got=%q",
+					i, expected, errs[i].Error())
+			}
+		}
+
+		if compiler.ByteCode() != nil {
+			t.Errorf("expected no bytecode after failed compilation")
+		}
+	}
+}
+
+func TestExceptions(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			input:             `throw "oops"`,
+			expectedConstants: []interface{}{"oops"},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpThrow),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input:             `try { 1 } catch (e) { e }`,
+			expectedConstants: []interface{}{1},
+			expectedInstructions: []code.Instructions{
+				// 0000
+				code.Make(code.OpConstant, 0),
+				// 0003
+				code.Make(code.OpJump, 12),
+				// 0006
+				code.Make(code.OpSetGlobal, 0),
+				// 0009
+				code.Make(code.OpGetGlobal, 0),
+				// 0012
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input:             `try { 1 } catch (e) { e } finally { 2 }`,
+			expectedConstants: []interface{}{1, 2},
+			expectedInstructions: []code.Instructions{
+				// 0000
+				code.Make(code.OpConstant, 0),
+				// 0003
+				code.Make(code.OpJump, 12),
+				// 0006
+				code.Make(code.OpSetGlobal, 0),
+				// 0009
+				code.Make(code.OpGetGlobal, 0),
+				// 0012
+				code.Make(code.OpSetGlobal, 1),
+				// 0015
+				code.Make(code.OpFalse),
+				// 0016
+				code.Make(code.OpSetGlobal, 2),
+				// 0019
+				code.Make(code.OpJump, 29),
+				// 0022
+				code.Make(code.OpSetGlobal, 1),
+				// 0025
+				code.Make(code.OpTrue),
+				// 0026
+				code.Make(code.OpSetGlobal, 2),
+				// 0029
+				code.Make(code.OpConstant, 1),
+				// 0032
+				code.Make(code.OpPop),
+				// 0033
+				code.Make(code.OpGetGlobal, 2),
+				// 0036
+				code.Make(code.OpJumpNotTruthy, 43),
+				// 0039
+				code.Make(code.OpGetGlobal, 1),
+				// 0042
+				code.Make(code.OpThrow),
+				// 0043
+				code.Make(code.OpGetGlobal, 1),
+				// 0046
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input: `fn() { try { 1 } catch (e) { e } }`,
+			expectedConstants: []interface{}{
+				1,
+				[]code.Instructions{
+					code.Make(code.OpConstant, 0),
+					code.Make(code.OpJump, 10),
+					code.Make(code.OpSetLocal, 0),
+					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpReturnValue),
+				},
+			},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpClosure, 1, 0),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			// return runs the finally block before it leaves the try
+			input: `fn() { try { return 1 } finally { 2 } }`,
+			expectedConstants: []interface{}{
+				1,
+				2,
+				2,
+				[]code.Instructions{
+					// 0000
+					code.Make(code.OpConstant, 0),
+					// 0003
+					code.Make(code.OpConstant, 1),
+					// 0006
+					code.Make(code.OpPop),
+					// 0007
+					code.Make(code.OpReturnValue),
+					// 0008
+					code.Make(code.OpNull),
+					// 0009
+					code.Make(code.OpJump, 12),
+					// 0012
+					code.Make(code.OpSetLocal, 0),
+					// 0014
+					code.Make(code.OpFalse),
+					// 0015
+					code.Make(code.OpSetLocal, 1),
+					// 0017
+					code.Make(code.OpJump, 25),
+					// 0020
+					code.Make(code.OpSetLocal, 0),
+					// 0022
+					code.Make(code.OpTrue),
+					// 0023
+					code.Make(code.OpSetLocal, 1),
+					// 0025
+					code.Make(code.OpConstant, 2),
+					// 0028
+					code.Make(code.OpPop),
+					// 0029
+					code.Make(code.OpGetLocal, 1),
+					// 0031
+					code.Make(code.OpJumpNotTruthy, 37),
+					// 0034
+					code.Make(code.OpGetLocal, 0),
+					// 0036
+					code.Make(code.OpThrow),
+					// 0037
+					code.Make(code.OpGetLocal, 0),
+					// 0039
+					code.Make(code.OpReturnValue),
+				},
+			},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpClosure, 3, 0),
+				code.Make(code.OpPop),
+			},
+		},
+	}
+
+	runCompilerTests(t, tests)
+}
+
+func TestExceptionHandlers(t *testing.T) {
+	tests := []struct {
+		input            string
+		expectedHandlers []compilerObject.Handler
+		// handlers of the first compiled function among the constants
+		expectedFnHandlers []compilerObject.Handler
+	}{
+		{
+			input:            `try { 1 } catch (e) { e }`,
+			expectedHandlers: []compilerObject.Handler{{Start: 0, End: 3, Target: 6, Depth: 0}},
+		},
+		{
+			input: `try { 1 } catch (e) { e } finally { 2 }`,
+			expectedHandlers: []compilerObject.Handler{
+				{Start: 0, End: 3, Target: 6, Depth: 0},
+				{Start: 9, End: 12, Target: 22, Depth: 0},
+			},
+		},
+		{
+			// the operands of the array are on the stack below the try
+			input:            `[1, 2, try { 3 } catch (e) { e }]`,
+			expectedHandlers: []compilerObject.Handler{{Start: 6, End: 9, Target: 12, Depth: 2}},
+		},
+		{
+			// nested tries come first
+			input: `try { try { 1 } catch (e) { e } } catch (e) { e }`,
+			expectedHandlers: []compilerObject.Handler{
+				{Start: 0, End: 3, Target: 6, Depth: 0},
+				{Start: 0, End: 12, Target: 15, Depth: 0},
+			},
+		},
+		{
+			input: `fn(a) { a + try { 1 } catch (e) { e } }`,
+			expectedFnHandlers: []compilerObject.Handler{
+				{Start: 2, End: 5, Target: 8, Depth: 1},
+			},
+		},
+		{
+			// the finally block inlined for the return isn't covered
+			input: `fn() { try { return 1 } catch (e) { e } finally { 2 } }`,
+			expectedFnHandlers: []compilerObject.Handler{
+				{Start: 0, End: 3, Target: 12, Depth: 0},
+				{Start: 7, End: 9, Target: 12, Depth: 0},
+				{Start: 14, End: 16, Target: 24, Depth: 0},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		compiler := New()
+		err := compiler.Compile(parse(tt.input))
+		if err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+
+		byteCode := compiler.ByteCode()
+
+		if !reflect.DeepEqual(byteCode.Handlers, tt.expectedHandlers) {
+			t.Errorf("wrong handlers for %q. want=%+v, got=%+v",
+				tt.input, tt.expectedHandlers, byteCode.Handlers)
+		}
+
+		if tt.expectedFnHandlers == nil {
+			continue
+		}
+		var handlers []compilerObject.Handler
+		for _, constant := range byteCode.Constants {
+			fn, ok := constant.(*compilerObject.CompiledFunction)
+			if ok && fn.Handlers != nil {
+				handlers = fn.Handlers
+				break
+			}
+		}
+		if !reflect.DeepEqual(handlers, tt.expectedFnHandlers) {
+			t.Errorf("wrong function handlers for %q. want=%+v, got=%+v",
+				tt.input, tt.expectedFnHandlers, handlers)
+		}
+	}
+}
+
+func TestGenerators(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			input: `fn() { let x = yield(1); x }`,
+			expectedConstants: []interface{}{
+				1,
+				[]code.Instructions{
+					code.Make(code.OpConstant, 0),
+					code.Make(code.OpYield),
+					code.Make(code.OpSetLocal, 0),
+					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpReturnValue),
+				},
+			},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpClosure, 1, 0),
+				code.Make(code.OpPop),
+			},
+		},
+	}
+
+	runCompilerTests(t, tests)
+
+	program := parse(`fn() { fn() { yield(1) } }`)
+	compiler := New()
+	err := compiler.Compile(program)
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	constants := compiler.ByteCode().Constants
+	inner := constants[1].(*compilerObject.CompiledFunction)
+	outer := constants[2].(*compilerObject.CompiledFunction)
+	if !inner.Generator {
+		t.Errorf("function that yields is not a generator")
+	}
+	if outer.Generator {
+		t.Errorf("function enclosing a generator is a generator")
+	}
+}
+
+type mapImporter map[string]string
+
+func (mi mapImporter) Resolve(from, path string) (string, error) {
+	return path, nil
+}
+
+func (mi mapImporter) Read(path string) (string, error) {
+	source, ok := mi[path]
+	if !ok {
+		return "", fmt.Errorf("module not found")
+	}
+	return source, nil
+}
+
+func TestImports(t *testing.T) {
+	importer := mapImporter{
+		"lib": `let X = 1; let hidden = 2;`,
+	}
+
+	compiler := New()
+	compiler.SetImporter(importer)
+
+	err := compiler.Compile(parse(`let x = 3; import "lib"; import "lib";`))
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	byteCode := compiler.ByteCode()
+
+	expectedInstructions := []code.Instructions{
+		code.Make(code.OpConstant, 0),
+		code.Make(code.OpSetGlobal, 0),
+		code.Make(code.OpImport, 4, 1),
+		code.Make(code.OpPop),
+		code.Make(code.OpImport, 4, 1),
+		code.Make(code.OpPop),
+	}
+	err = testInstructions(expectedInstructions, byteCode.Instructions)
+	if err != nil {
+		t.Errorf("test instructions failed: %s", err)
+	}
+
+	expectedConstants := []interface{}{
+		3,
+		1,
+		2,
+		"X",
+		[]code.Instructions{
+			code.Make(code.OpConstant, 1),
+			code.Make(code.OpSetGlobal, 2),
+			code.Make(code.OpConstant, 2),
+			code.Make(code.OpSetGlobal, 3),
+			code.Make(code.OpConstant, 3),
+			code.Make(code.OpGetGlobal, 2),
+			code.Make(code.OpHash, 2),
+			code.Make(code.OpSetGlobal, 1),
+			code.Make(code.OpGetGlobal, 1),
+			code.Make(code.OpReturnValue),
+		},
+	}
+	err = testConstants(expectedConstants, byteCode.Constants)
+	if err != nil {
+		t.Errorf("test constants failed: %s", err)
+	}
+}
+
+func TestImportsShareModulesAcrossCompilations(t *testing.T) {
+	importer := mapImporter{"lib": `let X = 1;`}
+
+	symbolTable := NewSymbolTable()
+	symbolTable.DefineBuiltins(compilerObject.NewRegistry())
+
+	first := NewWithState([]object.Object{}, symbolTable)
+	first.SetImporter(importer)
+	err := first.Compile(parse(`import "lib";`))
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+	firstByteCode := first.ByteCode()
+	numGlobals := *symbolTable.numGlobals
+
+	second := NewWithState(firstByteCode.Constants, symbolTable)
+	second.SetImporter(importer)
+	err = second.Compile(parse(`import "lib";`))
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+	secondByteCode := second.ByteCode()
+
+	if len(secondByteCode.Constants) != len(firstByteCode.Constants) {
+		t.Errorf("module compiled again. constants want=%d, got=%d",
+			len(firstByteCode.Constants), len(secondByteCode.Constants))
+	}
+	if *symbolTable.numGlobals != numGlobals {
+		t.Errorf("module globals allocated again. want=%d, got=%d",
+			numGlobals, *symbolTable.numGlobals)
+	}
+
+	err = testInstructions(
+		[]code.Instructions{code.Make(code.OpImport, 2, 0), code.Make(code.OpPop)},
+		secondByteCode.Instructions,
+	)
+	if err != nil {
+		t.Errorf("test instructions failed: %s", err)
+	}
+}
+
+func TestImportErrors(t *testing.T) {
+	importer := mapImporter{
+		"a":      `import "b"`,
+		"b":      `import "a"`,
+		"self":   `import "self"`,
+		"broken": `let x = y;`,
+		"syntax": `let = 1;`,
+		"return": `let f = fn() { return 1; }; if (true) { return 2; };`,
+	}
+
+	tests := []struct {
+		input         string
+		importer      Importer
+		expectedError string
+	}{
+		{`import "a"`, importer, `b:1:1: import cycle: a -> b -> a`},
+		{`import "self"`, importer, `self:1:1: import cycle: self -> self`},
+		{`import "broken"`, importer, `broken:1:9: undefined variable: y`},
+		{`import "return"`, importer, `return:1:41: return outside a function in a module`},
+		{`import "missing"`, importer, `1:1: cannot import "missing": module not found`},
+		{`import "syntax"`, importer, `1:1: cannot import "syntax": parser errors: ` +
+			`expected next token to be IDENT, got = instead.; no prefix parse function for = found`},
+		{`import "a"`, nil, `1:1: cannot import "a": no importer configured`},
+	}
+
+	for _, tt := range tests {
+		compiler := New()
+		if tt.importer != nil {
+			compiler.SetImporter(tt.importer)
+		}
+
+		err := compiler.Compile(parse(tt.input))
+		if err == nil {
+			t.Fatalf("expected compiler error but resulted in none.")
+		}
+		if err.Error() != tt.expectedError {
+			t.Errorf("wrong compiler error. want=%q, got=%q", tt.expectedError, err)
+		}
+	}
+}
+
+func TestFileImporter(t *testing.T) {
+	dir := t.TempDir()
+	err := os.MkdirAll(filepath.Join(dir, "lib"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	importer := FileImporter{Root: dir}
+
+	main, err := importer.Resolve("", "lib/a.monkey")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if main != filepath.Join(dir, "lib", "a.monkey") {
+		t.Errorf("wrong path for main import. got=%s", main)
+	}
+
+	nested, err := importer.Resolve(main, "../b.monkey")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nested != filepath.Join(dir, "b.monkey") {
+		t.Errorf("wrong path for nested import. got=%s", nested)
+	}
+
+	err = os.WriteFile(nested, []byte("let b = 1;"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	source, err := importer.Read(nested)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if source != "let b = 1;" {
+		t.Errorf("wrong source. got=%q", source)
+	}
+}
+
+func TestUnits(t *testing.T) {
+	compiler := New()
+	compiler.AllowExternals()
+	compiler.SetImporter(mapImporter{"lib": `let missing = 1; let X = missing;`})
+
+	err := compiler.Compile(parse(`
+	let a = b;
+	let f = fn() { c + a };
+	let c = 2;
+	import "lib";
+	`))
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	unit := compiler.Unit()
+
+	expectedGlobals := map[string]int{"a": 0, "f": 2, "c": 3}
+	if !reflect.DeepEqual(unit.Globals, expectedGlobals) {
+		t.Errorf("wrong globals. want=%v, got=%v", expectedGlobals, unit.Globals)
+	}
+
+	expectedExternals := map[string]int{"b": 1}
+	if !reflect.DeepEqual(unit.Externals, expectedExternals) {
+		t.Errorf("wrong externals. want=%v, got=%v", expectedExternals, unit.Externals)
+	}
+
+	expectedImports := map[string]int{"lib": 4}
+	if !reflect.DeepEqual(unit.Imports, expectedImports) {
+		t.Errorf("wrong imports. want=%v, got=%v", expectedImports, unit.Imports)
+	}
+
+	if unit.NumGlobals != 7 {
+		t.Errorf("wrong number of globals. want=7, got=%d", unit.NumGlobals)
+	}
+}
+
+func TestUnitsReportUndefinedNamesInModules(t *testing.T) {
+	compiler := New()
+	compiler.AllowExternals()
+	compiler.SetImporter(mapImporter{"lib": `let X = missing;`})
+
+	err := compiler.Compile(parse(`import "lib"`))
+	if err == nil {
+		t.Fatalf("expected compiler error but resulted in none.")
+	}
+
+	expected := "lib:1:9: undefined variable: missing"
+	if err.Error() != expected {
+		t.Errorf("wrong compiler error. want=%q, got=%q", expected, err)
+	}
+	if compiler.Unit() != nil {
+		t.Errorf("expected no unit after compiler errors")
+	}
+}
+
 func runCompilerTests(t *testing.T, tests []compilerTestCase) {
 	t.Helper()
 
@@ -1010,6 +1963,13 @@ func testConstants(expected []interface{}, actual []object.Object) error {
 					i, constant, actual[i])
 			}
 
+		case float64:
+			float, ok := actual[i].(*compilerObject.Float)
+			if !ok || float.Value != constant {
+				return fmt.Errorf("wrong constant at %d. \nwant=%v,\n got=%v",
+					i, constant, actual[i])
+			}
+
 		case []code.Instructions:
 			fn, ok := actual[i].(*compilerObject.CompiledFunction)
 			if !ok {
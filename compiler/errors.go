@@ -0,0 +1,36 @@
+package compiler
+
+import (
+	"fmt"
+	"github.com/carmooo/monkey_compiler/ast"
+	"github.com/carmooo/monkey_compiler/token"
+	"strings"
+)
+
+// CompileError is a single recoverable error found during compilation.
+// Position is the line and column of the node the error was found at, in
+// the source of Module for errors in imported code.
+type CompileError struct {
+	Message  string
+	Module   string
+	Position token.Position
+	Node     ast.Node
+}
+
+func (e *CompileError) Error() string {
+	if e.Module != "" {
+		return fmt.Sprintf("%s:%s: %s", e.Module, e.Position, e.Message)
+	}
+	return fmt.Sprintf("%s: %s", e.Position, e.Message)
+}
+
+// CompileErrors aggregates every error reported by a single Compile call.
+type CompileErrors []*CompileError
+
+func (errs CompileErrors) Error() string {
+	messages := make([]string, len(errs))
+	for i, err := range errs {
+		messages[i] = err.Error()
+	}
+	return strings.Join(messages, "\n")
+}
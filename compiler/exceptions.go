@@ -0,0 +1,310 @@
+package compiler
+
+import (
+	"fmt"
+
+	"github.com/carmooo/monkey_compiler/ast"
+	"github.com/carmooo/monkey_compiler/code"
+	compilerObject "github.com/carmooo/monkey_compiler/object"
+)
+
+// tryContext is a try whose body or catch is being compiled. A return,
+// break or continue jumping out of it runs its finally block first.
+type tryContext struct {
+	finally *ast.BlockStatement
+	// number of loops of the scope when the try started
+	loops int
+	// the ranges of finally blocks inlined inside the try for the jumps
+	// leaving it, which its handlers don't cover
+	gaps [][2]int
+}
+
+// tryHandler is an entry of the exception table being compiled. The depth
+// of the stack it restores is the one at tryStart, as a finally block
+// inlined in the middle of a try splits its entries.
+type tryHandler struct {
+	compilerObject.Handler
+	tryStart int
+}
+
+// compileThrow compiles throw value, which raises value as an error that
+// unwinds to the nearest enclosing try.
+func (c *Compiler) compileThrow(node *ast.ThrowExpression) error {
+	err := c.compile(node.Value)
+	if err != nil {
+		return err
+	}
+
+	c.emit(code.OpThrow)
+
+	return nil
+}
+
+// compileTry compiles a try expression inline. The handlers of the body
+// send an error to the catch block, whose value is used instead of the
+// body's, and the handlers of the catch block send it to the finally
+// block, which raises it again after it ran:
+//
+//	           <body>
+//	           OpJump done
+//	catch:     OpSet<parameter>
+//	           <catch>
+//	done:      OpSet<result>, OpFalse, OpSet<failed>
+//	           OpJump finally
+//	rethrow:   OpSet<result>, OpTrue, OpSet<failed>
+//	finally:   <finally>
+//	           OpPop
+//	           OpGet<failed>
+//	           OpJumpNotTruthy end
+//	           OpGet<result>
+//	           OpThrow
+//	end:       OpGet<result>
+//
+// The result and the error are kept in hidden symbols rather than on the
+// stack, so that the finally block can use return, break and continue.
+// Without a catch block, the handlers of the body go to rethrow, and
+// without a finally block, the try ends at done.
+func (c *Compiler) compileTry(node *ast.TryExpression) error {
+	try := &tryContext{finally: node.Finally, loops: len(c.scopes[c.scopeIndex].loops)}
+	c.scopes[c.scopeIndex].tries = append(c.scopes[c.scopeIndex].tries, try)
+	popTry := func() {
+		tries := c.scopes[c.scopeIndex].tries
+		c.scopes[c.scopeIndex].tries = tries[:len(tries)-1]
+	}
+
+	tryStart := len(c.currentInstructions())
+	err := c.compile(node.Body)
+	if err != nil {
+		return err
+	}
+	c.leaveBlockValue()
+	bodyEnd := len(c.currentInstructions())
+	doneJumpPos := c.emit(code.OpJump, 9999)
+
+	// the range whose errors go to the finally block
+	guardedStart, guardedEnd := tryStart, bodyEnd
+
+	if node.Catch != nil {
+		// the VM jumps here with the error on the stack
+		c.addHandler(try, tryStart, tryStart, bodyEnd, len(c.currentInstructions()))
+		c.storeSymbol(c.symbolTable.Define(node.Parameter.Value))
+
+		guardedStart = len(c.currentInstructions())
+		err = c.compile(node.Catch)
+		if err != nil {
+			return err
+		}
+		c.leaveBlockValue()
+		guardedEnd = len(c.currentInstructions())
+	}
+
+	popTry()
+	c.changeOperand(doneJumpPos, len(c.currentInstructions()))
+
+	if node.Finally == nil {
+		return nil
+	}
+
+	result := c.defineTryTemporary("result")
+	failed := c.defineTryTemporary("failed")
+
+	c.storeSymbol(result)
+	c.emit(code.OpFalse)
+	c.storeSymbol(failed)
+	finallyJumpPos := c.emit(code.OpJump, 9999)
+
+	c.addHandler(try, tryStart, guardedStart, guardedEnd, len(c.currentInstructions()))
+	c.storeSymbol(result)
+	c.emit(code.OpTrue)
+	c.storeSymbol(failed)
+
+	c.changeOperand(finallyJumpPos, len(c.currentInstructions()))
+	err = c.compile(node.Finally)
+	if err != nil {
+		return err
+	}
+	c.leaveBlockValue()
+	c.emit(code.OpPop)
+
+	c.loadSymbol(failed)
+	endJumpPos := c.emit(code.OpJumpNotTruthy, 9999)
+	c.loadSymbol(result)
+	c.emit(code.OpThrow)
+
+	c.changeOperand(endJumpPos, len(c.currentInstructions()))
+	c.loadSymbol(result)
+
+	return nil
+}
+
+// leaveTries runs the finally blocks of the tries of the current scope from
+// the one at index from on, innermost first, for a return, break or
+// continue jumping out of them. Each block is compiled without the tries
+// and loops it is outside of, and isn't covered by their handlers.
+func (c *Compiler) leaveTries(from int) error {
+	scope := &c.scopes[c.scopeIndex]
+	tries, loops := scope.tries, scope.loops
+	defer func() {
+		c.scopes[c.scopeIndex].tries = tries
+		c.scopes[c.scopeIndex].loops = loops
+	}()
+
+	for i := len(tries) - 1; i >= from; i-- {
+		if tries[i].finally == nil {
+			continue
+		}
+
+		c.scopes[c.scopeIndex].tries = tries[:i]
+		c.scopes[c.scopeIndex].loops = loops[:tries[i].loops]
+
+		start := len(c.currentInstructions())
+		err := c.compile(tries[i].finally)
+		if err != nil {
+			return err
+		}
+		c.leaveBlockValue()
+		c.emit(code.OpPop)
+		end := len(c.currentInstructions())
+
+		for _, try := range tries[i:] {
+			try.gaps = append(try.gaps, [2]int{start, end})
+		}
+	}
+
+	return nil
+}
+
+// defineTryTemporary binds a symbol in the current scope that holds the
+// state of a try while its finally block runs.
+func (c *Compiler) defineTryTemporary(role string) Symbol {
+	c.tryTemporaries++
+	return c.symbolTable.defineHidden(fmt.Sprintf("try %s %d", role, c.tryTemporaries))
+}
+
+// addHandler adds entries to the exception table of the current scope that
+// send the errors raised between start and end to target, except in the
+// gaps of the try. Tries are added once their body is compiled, so the
+// handlers of nested tries come before the ones enclosing them.
+func (c *Compiler) addHandler(try *tryContext, tryStart, start, end, target int) {
+	for _, gap := range try.gaps {
+		if gap[0] < start || gap[1] > end {
+			continue
+		}
+		c.appendHandler(tryStart, start, gap[0], target)
+		start = gap[1]
+	}
+	c.appendHandler(tryStart, start, end, target)
+}
+
+func (c *Compiler) appendHandler(tryStart, start, end, target int) {
+	if start == end {
+		return
+	}
+
+	c.scopes[c.scopeIndex].handlers = append(c.scopes[c.scopeIndex].handlers, tryHandler{
+		Handler:  compilerObject.Handler{Start: start, End: end, Target: target},
+		tryStart: tryStart,
+	})
+}
+
+// scopeHandlers returns the exception table of the current scope, with the
+// depth of the stack at the start of every try, which the VM restores when
+// it unwinds to the handler.
+func (c *Compiler) scopeHandlers() []compilerObject.Handler {
+	scope := c.scopes[c.scopeIndex]
+	if len(scope.handlers) == 0 {
+		return nil
+	}
+
+	depths := stackDepths(scope.instructions, scope.handlers)
+
+	handlers := make([]compilerObject.Handler, len(scope.handlers))
+	for i, h := range scope.handlers {
+		// the depth of a try in unreachable code doesn't matter
+		h.Depth = depths[h.tryStart]
+		handlers[i] = h.Handler
+	}
+
+	return handlers
+}
+
+// stackDepths follows every path through ins and returns the number of
+// operands on the stack before each reachable instruction. Handlers are
+// reached by unwinding instead of jumps, with the error pushed on the
+// stack as it was at the start of their try.
+func stackDepths(ins code.Instructions, handlers []tryHandler) map[int]int {
+	depths := make(map[int]int)
+	var pending []int
+
+	visit := func(pos, depth int) {
+		if _, ok := depths[pos]; !ok && pos < len(ins) {
+			depths[pos] = depth
+			pending = append(pending, pos)
+		}
+	}
+
+	visit(0, 0)
+	for len(pending) > 0 {
+		for len(pending) > 0 {
+			pos := pending[len(pending)-1]
+			pending = pending[:len(pending)-1]
+
+			op := code.Opcode(ins[pos])
+			def, err := code.Lookup(ins[pos])
+			if err != nil {
+				continue
+			}
+			operands, read := code.ReadOperands(def, ins[pos+1:])
+			next := pos + 1 + read
+			depth := depths[pos]
+
+			switch op {
+			case code.OpJump:
+				visit(operands[0], depth)
+			case code.OpJumpNotTruthy:
+				visit(operands[0], depth-1)
+				visit(next, depth-1)
+			case code.OpReturnValue, code.OpReturn, code.OpThrow:
+			default:
+				visit(next, depth+stackEffect(op, operands))
+			}
+		}
+
+		for _, h := range handlers {
+			if depth, ok := depths[h.tryStart]; ok {
+				visit(h.Target, depth+1)
+			}
+		}
+	}
+
+	return depths
+}
+
+// stackEffect returns how many operands an instruction that falls through
+// to the next one adds to the stack, or removes if negative.
+func stackEffect(op code.Opcode, operands []int) int {
+	switch op {
+	case code.OpConstant, code.OpTrue, code.OpFalse, code.OpNull,
+		code.OpGetGlobal, code.OpGetLocal, code.OpGetBuiltin, code.OpGetFree,
+		code.OpCaptureLocal, code.OpCaptureFree, code.OpImport:
+		return 1
+	case code.OpDupPair:
+		return 2
+	case code.OpAdd, code.OpSub, code.OpMul, code.OpDiv, code.OpMod,
+		code.OpEqual, code.OpNotEqual, code.OpGreaterThan, code.OpGreaterThanOrEqual,
+		code.OpIn, code.OpIndex, code.OpPop,
+		code.OpSetGlobal, code.OpSetLocal, code.OpSetFree:
+		return -1
+	case code.OpSetIndex:
+		return -2
+	case code.OpArray, code.OpHash:
+		return 1 - operands[0]
+	case code.OpCall:
+		return -operands[0]
+	case code.OpClosure:
+		return 1 - operands[1]
+	default:
+		// OpMinus, OpBang and OpYield replace the operand on top
+		return 0
+	}
+}
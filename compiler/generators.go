@@ -0,0 +1,47 @@
+package compiler
+
+import (
+	"github.com/carmooo/monkey_compiler/ast"
+	"github.com/carmooo/monkey_compiler/code"
+)
+
+// isIntrinsic reports whether the call is to the intrinsic name, which is
+// recognized by its callee as long as a script doesn't bind the name itself.
+func (c *Compiler) isIntrinsic(node *ast.CallExpression, name string) bool {
+	ident, ok := node.Function.(*ast.Identifier)
+	if !ok || ident.Value != name {
+		return false
+	}
+
+	_, defined := c.symbolTable.Resolve(ident.Value)
+	return !defined
+}
+
+// compileYield compiles yield(value), which suspends the generator running
+// the function and hands value to whoever resumed it. The yield evaluates
+// to the value the generator is resumed with. Any function that yields is
+// a generator function.
+func (c *Compiler) compileYield(node *ast.CallExpression) error {
+	scope := &c.scopes[c.scopeIndex]
+
+	switch {
+	case len(node.Arguments) != 1:
+		c.addError(node, "yield expects a single value")
+		c.emit(code.OpNull)
+		return nil
+	case !scope.function:
+		c.addError(node, "yield outside a function")
+		c.emit(code.OpNull)
+		return nil
+	}
+
+	err := c.compile(node.Arguments[0])
+	if err != nil {
+		return err
+	}
+
+	c.scopes[c.scopeIndex].yields = true
+	c.emit(code.OpYield)
+
+	return nil
+}
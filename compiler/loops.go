@@ -0,0 +1,174 @@
+package compiler
+
+import (
+	"github.com/carmooo/monkey_compiler/ast"
+	"github.com/carmooo/monkey_compiler/code"
+)
+
+// loopContext collects the jumps of break and continue statements of a loop
+// being compiled, which are back-patched once their targets are known.
+type loopContext struct {
+	// number of pending operands when the loop started
+	operands  int
+	breaks    []int
+	continues []int
+}
+
+// compileWhile compiles a while loop. The condition is checked before every
+// iteration and the loop evaluates to null:
+//
+//	condition: <condition>
+//	           OpJumpNotTruthy exit
+//	           <body>
+//	           OpJump condition
+//	exit:      OpNull
+func (c *Compiler) compileWhile(node *ast.WhileExpression) error {
+	conditionPos := len(c.currentInstructions())
+
+	err := c.compile(node.Condition)
+	if err != nil {
+		return err
+	}
+
+	exitJumpPos := c.emit(code.OpJumpNotTruthy, 9999)
+
+	loop, err := c.compileLoopBody(node.Body)
+	if err != nil {
+		return err
+	}
+
+	c.emit(code.OpJump, conditionPos)
+
+	exitPos := len(c.currentInstructions())
+	c.changeOperand(exitJumpPos, exitPos)
+	c.patchJumps(loop.continues, conditionPos)
+	c.patchJumps(loop.breaks, exitPos)
+
+	c.emit(code.OpNull)
+
+	return nil
+}
+
+// compileFor compiles a C-style for loop. continue jumps to the post
+// statement, and a loop without a condition only ends with break.
+func (c *Compiler) compileFor(node *ast.ForExpression) error {
+	if node.Init != nil {
+		err := c.compile(node.Init)
+		if err != nil {
+			return err
+		}
+	}
+
+	conditionPos := len(c.currentInstructions())
+
+	exitJumpPos := -1
+	if node.Condition != nil {
+		err := c.compile(node.Condition)
+		if err != nil {
+			return err
+		}
+
+		exitJumpPos = c.emit(code.OpJumpNotTruthy, 9999)
+	}
+
+	loop, err := c.compileLoopBody(node.Body)
+	if err != nil {
+		return err
+	}
+
+	postPos := len(c.currentInstructions())
+	if node.Post != nil {
+		err := c.compile(node.Post)
+		if err != nil {
+			return err
+		}
+	}
+
+	c.emit(code.OpJump, conditionPos)
+
+	exitPos := len(c.currentInstructions())
+	if exitJumpPos >= 0 {
+		c.changeOperand(exitJumpPos, exitPos)
+	}
+	c.patchJumps(loop.continues, postPos)
+	c.patchJumps(loop.breaks, exitPos)
+
+	c.emit(code.OpNull)
+
+	return nil
+}
+
+// compileLoopBody compiles the body of a loop with a new loop context on
+// the stack of the current scope. Loops of enclosing functions are not
+// visible to the body of a function literal, since every scope has its own.
+func (c *Compiler) compileLoopBody(body *ast.BlockStatement) (*loopContext, error) {
+	loop := &loopContext{operands: c.scopes[c.scopeIndex].operands}
+
+	c.scopes[c.scopeIndex].loops = append(c.scopes[c.scopeIndex].loops, loop)
+	defer func() {
+		loops := c.scopes[c.scopeIndex].loops
+		c.scopes[c.scopeIndex].loops = loops[:len(loops)-1]
+	}()
+
+	err := c.compile(body)
+	if err != nil {
+		return nil, err
+	}
+
+	return loop, nil
+}
+
+// compileLoopJump emits the jump of a break or continue statement in the
+// innermost loop, which is patched when the loop is done. The jump can't
+// drop operands, so it is only allowed where no operand of an enclosing
+// expression is waiting on the stack. The finally blocks of the tries it
+// jumps out of run before it.
+func (c *Compiler) compileLoopJump(node ast.Statement) error {
+	scope := c.scopes[c.scopeIndex]
+	if len(scope.loops) == 0 {
+		c.addError(node, "%s outside a loop", node.TokenLiteral())
+		return nil
+	}
+
+	loop := scope.loops[len(scope.loops)-1]
+	if scope.operands != loop.operands {
+		c.addError(node, "%s inside an expression", node.TokenLiteral())
+		return nil
+	}
+
+	// run the finally blocks of the tries inside the loop
+	tries := scope.tries
+	from := len(tries)
+	for from > 0 && tries[from-1].loops == len(scope.loops) {
+		from--
+	}
+	err := c.leaveTries(from)
+	if err != nil {
+		return err
+	}
+
+	pos := c.emit(code.OpJump, 9999)
+
+	if _, ok := node.(*ast.BreakStatement); ok {
+		loop.breaks = append(loop.breaks, pos)
+	} else {
+		loop.continues = append(loop.continues, pos)
+	}
+
+	return nil
+}
+
+func (c *Compiler) patchJumps(positions []int, target int) {
+	for _, pos := range positions {
+		c.changeOperand(pos, target)
+	}
+}
+
+// compileOperand compiles an operand of an expression while the values of
+// the operands before it may still be on the stack.
+func (c *Compiler) compileOperand(node ast.Node) error {
+	c.scopes[c.scopeIndex].operands++
+	defer func() { c.scopes[c.scopeIndex].operands-- }()
+
+	return c.compile(node)
+}
@@ -0,0 +1,186 @@
+package compiler
+
+import (
+	"fmt"
+	"github.com/carmooo/monkey_compiler/ast"
+	"github.com/carmooo/monkey_compiler/code"
+	"github.com/carmooo/monkey_compiler/lexer"
+	compilerObject "github.com/carmooo/monkey_compiler/object"
+	"github.com/carmooo/monkey_compiler/parser"
+	"github.com/carmooo/monkey_interpreter/object"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Importer locates and reads the source of imported modules.
+type Importer interface {
+	// Resolve turns the path given to import into a canonical module path.
+	// from is the canonical path of the importing module, or "" for the
+	// main program.
+	Resolve(from, path string) (string, error)
+	Read(path string) (string, error)
+}
+
+// FileImporter imports modules from the file system. Paths are relative to
+// the importing module, or to Root for the main program.
+type FileImporter struct {
+	Root string
+}
+
+func (fi FileImporter) Resolve(from, path string) (string, error) {
+	if !filepath.IsAbs(path) {
+		dir := fi.Root
+		if from != "" {
+			dir = filepath.Dir(from)
+		}
+		path = filepath.Join(dir, path)
+	}
+
+	return filepath.Abs(path)
+}
+
+func (fi FileImporter) Read(path string) (string, error) {
+	source, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return string(source), nil
+}
+
+type compiledModule struct {
+	constant int
+	slot     int
+}
+
+// SetImporter enables import "path" expressions. Without an importer
+// every import is a compile error.
+func (c *Compiler) SetImporter(importer Importer) {
+	c.importer = importer
+}
+
+// compileImport emits OpImport, which runs the module the first time it
+// is reached and evaluates to a hash of the module's exported globals.
+// Every module is compiled once per main symbol table and run once per
+// globals store.
+func (c *Compiler) compileImport(node *ast.ImportExpression) error {
+	path := node.Path.Value
+
+	if c.importer == nil {
+		c.addError(node, "cannot import %q: no importer configured", path)
+		c.emit(code.OpNull)
+		return nil
+	}
+
+	resolved, err := c.importer.Resolve(c.module, path)
+	if err != nil {
+		c.addError(node, "cannot import %q: %s", path, err)
+		c.emit(code.OpNull)
+		return nil
+	}
+
+	module, ok := c.mainSymbolTable.modules[resolved]
+	if !ok {
+		for i, importing := range c.importStack {
+			if importing == resolved {
+				cycle := append(c.importStack[i:], resolved)
+				c.addError(node, "import cycle: %s", strings.Join(cycle, " -> "))
+				c.emit(code.OpNull)
+				return nil
+			}
+		}
+
+		source, err := c.importer.Read(resolved)
+		if err != nil {
+			c.addError(node, "cannot import %q: %s", path, err)
+			c.emit(code.OpNull)
+			return nil
+		}
+
+		p := parser.New(lexer.New(source))
+		program := p.ParseProgram()
+		if len(p.Errors()) > 0 {
+			c.addError(node, "cannot import %q: parser errors: %s",
+				path, strings.Join(p.Errors(), "; "))
+			c.emit(code.OpNull)
+			return nil
+		}
+
+		module, err = c.compileModule(resolved, program)
+		if err != nil {
+			return err
+		}
+		if c.mainSymbolTable.modules == nil {
+			c.mainSymbolTable.modules = make(map[string]compiledModule)
+		}
+		c.mainSymbolTable.modules[resolved] = module
+	}
+
+	c.emit(code.OpImport, module.constant, module.slot)
+
+	return nil
+}
+
+// compileModule compiles the module into a function with its own global
+// namespace. The function stores the hash of exports into the module's
+// cache slot and returns it. As in Go, only globals whose name starts with
+// an upper case letter are exported.
+func (c *Compiler) compileModule(path string, program *ast.Program) (compiledModule, error) {
+	// the cache slot lives in the main table, so later compilations that
+	// share it, like the lines of a REPL session, find the cached module
+	slot := c.mainSymbolTable.defineHidden(fmt.Sprintf("import %q", path))
+
+	outerSymbolTable := c.symbolTable
+	outerModule := c.module
+
+	moduleSymbolTable := NewModuleSymbolTable(c.mainSymbolTable)
+
+	c.scopes = append(c.scopes, CompilationScope{instructions: code.Instructions{}})
+	c.scopeIndex++
+	c.symbolTable = moduleSymbolTable
+	c.module = path
+	c.importStack = append(c.importStack, path)
+
+	defer func() {
+		c.scopes = c.scopes[:c.scopeIndex]
+		c.scopeIndex--
+		c.symbolTable = outerSymbolTable
+		c.module = outerModule
+		c.importStack = c.importStack[:len(c.importStack)-1]
+	}()
+
+	for _, s := range program.Statements {
+		err := c.compile(s)
+		if err != nil {
+			return compiledModule{}, err
+		}
+	}
+
+	exports := moduleSymbolTable.exports()
+	for _, sym := range exports {
+		c.emit(code.OpConstant, c.addConstant(&object.String{Value: sym.Name}))
+		c.emit(code.OpGetGlobal, sym.Index)
+	}
+	c.emit(code.OpHash, len(exports)*2)
+	c.emit(code.OpSetGlobal, slot.Index)
+	c.emit(code.OpGetGlobal, slot.Index)
+	c.emit(code.OpReturnValue)
+
+	fn := &compilerObject.CompiledFunction{
+		Instructions: c.currentInstructions(),
+		Handlers:     c.scopeHandlers(),
+	}
+
+	return compiledModule{constant: c.addConstant(fn), slot: slot.Index}, nil
+}
+
+// exports returns the exported globals of a module table sorted by name.
+func (st *SymbolTable) exports() []Symbol {
+	var exports []Symbol
+	for _, sym := range st.Globals() {
+		if 'A' <= sym.Name[0] && sym.Name[0] <= 'Z' {
+			exports = append(exports, sym)
+		}
+	}
+	return exports
+}
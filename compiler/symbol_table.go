@@ -1,5 +1,11 @@
 package compiler
 
+import (
+	compilerObject "github.com/carmooo/monkey_compiler/object"
+	"maps"
+	"sort"
+)
+
 type SymbolScope string
 
 const (
@@ -21,11 +27,43 @@ type SymbolTable struct {
 
 	store          map[string]Symbol
 	numDefinitions int
+
+	// numGlobals is shared by all global tables of one program, so every
+	// module gets its own namespace but distinct slots in the globals store
+	numGlobals *int
+
+	// externals are globals that a separately compiled unit uses without
+	// defining them, left for the linker to resolve
+	externals map[string]bool
+
+	// hidden globals, like the import caches, are not visible by name to
+	// hosts or other modules
+	hidden map[string]bool
+
+	// modules compiled against the main table, so compilers that share it,
+	// like the lines of a REPL session, compile every module only once
+	modules map[string]compiledModule
 }
 
 func NewSymbolTable() *SymbolTable {
 	s := make(map[string]Symbol)
-	return &SymbolTable{store: s}
+	return &SymbolTable{store: s, numGlobals: new(int)}
+}
+
+// NewModuleSymbolTable creates the global table of an imported module. It
+// sees the builtins of main but none of its globals, and allocates its
+// global slots from the same store.
+func NewModuleSymbolTable(main *SymbolTable) *SymbolTable {
+	s := NewSymbolTable()
+	s.numGlobals = main.numGlobals
+
+	for name, sym := range main.store {
+		if sym.Scope == BuiltInScope {
+			s.store[name] = sym
+		}
+	}
+
+	return s
 }
 
 func NewEnclosedSymbolTable(outer *SymbolTable) *SymbolTable {
@@ -35,7 +73,18 @@ func NewEnclosedSymbolTable(outer *SymbolTable) *SymbolTable {
 	return s
 }
 
+// Define binds name in this table. Redefining a name that is already bound
+// here reuses its slot instead of allocating a new one, so a second let of
+// a name in the same scope behaves like an assignment: a let in a loop body
+// updates the binding the loop condition reads, and a REPL session doesn't
+// use up a global slot every time a line redefines a name.
 func (st *SymbolTable) Define(name string) Symbol {
+	delete(st.externals, name)
+
+	if sym, ok := st.store[name]; ok && (sym.Scope == GlobalScope || sym.Scope == LocalScope) {
+		return sym
+	}
+
 	sym := Symbol{
 		Name:  name,
 		Index: st.numDefinitions,
@@ -43,6 +92,8 @@ func (st *SymbolTable) Define(name string) Symbol {
 
 	if st.Outer == nil {
 		sym.Scope = GlobalScope
+		sym.Index = *st.numGlobals
+		*st.numGlobals++
 	} else {
 		sym.Scope = LocalScope
 	}
@@ -52,6 +103,83 @@ func (st *SymbolTable) Define(name string) Symbol {
 	return sym
 }
 
+// defineExternal binds name to a global slot that another unit is expected
+// to define. Defining the name later in this table makes it a regular
+// global again.
+func (st *SymbolTable) defineExternal(name string) Symbol {
+	sym := st.Define(name)
+
+	if st.externals == nil {
+		st.externals = make(map[string]bool)
+	}
+	st.externals[name] = true
+
+	return sym
+}
+
+// defineHidden binds a symbol that scripts cannot name.
+func (st *SymbolTable) defineHidden(name string) Symbol {
+	sym := st.Define(name)
+
+	if st.hidden == nil {
+		st.hidden = make(map[string]bool)
+	}
+	st.hidden[name] = true
+
+	return sym
+}
+
+// Globals returns the globals defined in this table sorted by name,
+// including externals but not hidden globals.
+func (st *SymbolTable) Globals() []Symbol {
+	var globals []Symbol
+	for name, sym := range st.store {
+		if sym.Scope == GlobalScope && !st.hidden[name] {
+			globals = append(globals, sym)
+		}
+	}
+
+	sort.Slice(globals, func(i, j int) bool {
+		return globals[i].Name < globals[j].Name
+	})
+
+	return globals
+}
+
+// SymbolTableSnapshot is the state of a global table at one point, taken
+// by Snapshot.
+type SymbolTableSnapshot struct {
+	store          map[string]Symbol
+	numDefinitions int
+	numGlobals     int
+	externals      map[string]bool
+	hidden         map[string]bool
+	modules        map[string]compiledModule
+}
+
+// Snapshot saves the definitions of a global table, so they can be rolled
+// back with Restore when a compilation against the table fails.
+func (st *SymbolTable) Snapshot() SymbolTableSnapshot {
+	return SymbolTableSnapshot{
+		store:          maps.Clone(st.store),
+		numDefinitions: st.numDefinitions,
+		numGlobals:     *st.numGlobals,
+		externals:      maps.Clone(st.externals),
+		hidden:         maps.Clone(st.hidden),
+		modules:        maps.Clone(st.modules),
+	}
+}
+
+// Restore drops every definition made since the snapshot was taken.
+func (st *SymbolTable) Restore(snapshot SymbolTableSnapshot) {
+	st.store = maps.Clone(snapshot.store)
+	st.numDefinitions = snapshot.numDefinitions
+	*st.numGlobals = snapshot.numGlobals
+	st.externals = maps.Clone(snapshot.externals)
+	st.hidden = maps.Clone(snapshot.hidden)
+	st.modules = maps.Clone(snapshot.modules)
+}
+
 func (st *SymbolTable) DefineBuiltin(index int, name string) Symbol {
 	sym := Symbol{
 		Name:  name,
@@ -62,6 +190,15 @@ func (st *SymbolTable) DefineBuiltin(index int, name string) Symbol {
 	return sym
 }
 
+// DefineBuiltins defines every builtin of the registry at its index.
+func (st *SymbolTable) DefineBuiltins(builtins *compilerObject.Registry) {
+	for i := 0; i < builtins.Len(); i++ {
+		if def, ok := builtins.Get(i); ok {
+			st.DefineBuiltin(i, def.Name)
+		}
+	}
+}
+
 func (st *SymbolTable) Resolve(name string) (Symbol, bool) {
 	sym, ok := st.store[name]
 
@@ -1,6 +1,8 @@
 package compiler
 
 import (
+	compilerObject "github.com/carmooo/monkey_compiler/object"
+	"github.com/carmooo/monkey_interpreter/object"
 	"testing"
 )
 
@@ -182,6 +184,41 @@ func TestDefineResolveBuiltins(t *testing.T) {
 	}
 }
 
+func TestDefineBuiltinsFromRegistry(t *testing.T) {
+	builtins := compilerObject.NewEmptyRegistry()
+	noop := func(args ...object.Object) object.Object { return nil }
+
+	builtins.Register("a", 0, noop)
+	builtins.Register("b", 1, noop)
+	builtins.Register("c", compilerObject.Variadic, noop)
+	builtins.Remove("b")
+	builtins.Register("a", 2, noop)
+	builtins.Register("d", 0, noop)
+
+	global := NewSymbolTable()
+	global.DefineBuiltins(builtins)
+
+	expected := []Symbol{
+		{Name: "a", Scope: BuiltInScope, Index: 0},
+		{Name: "c", Scope: BuiltInScope, Index: 2},
+		{Name: "d", Scope: BuiltInScope, Index: 3},
+	}
+
+	for _, sym := range expected {
+		result, ok := global.Resolve(sym.Name)
+		if !ok {
+			t.Errorf("name %s is not resolvable", sym.Name)
+		}
+		if result != sym {
+			t.Errorf("expected %s to resolve to %+v, got=%+v", sym.Name, sym, result)
+		}
+	}
+
+	if _, ok := global.Resolve("b"); ok {
+		t.Errorf("removed builtin b is resolvable")
+	}
+}
+
 func TestResolveFree(t *testing.T) {
 	global := NewSymbolTable()
 	global.Define("a")
@@ -296,3 +333,59 @@ func TestResolveUnresolvableFree(t *testing.T) {
 		}
 	}
 }
+
+func TestRedefine(t *testing.T) {
+	global := NewSymbolTable()
+	global.Define("a")
+	global.Define("b")
+
+	redefined := global.Define("a")
+	expected := Symbol{Name: "a", Scope: GlobalScope, Index: 0}
+	if redefined != expected {
+		t.Errorf("expected %+v, got=%+v", expected, redefined)
+	}
+
+	local := NewEnclosedSymbolTable(global)
+	local.Define("a")
+	shadowing := local.Define("a")
+	expected = Symbol{Name: "a", Scope: LocalScope, Index: 0}
+	if shadowing != expected {
+		t.Errorf("expected %+v, got=%+v", expected, shadowing)
+	}
+
+	if global.numDefinitions != 2 {
+		t.Errorf("wrong number of global definitions. want=2, got=%d",
+			global.numDefinitions)
+	}
+	if local.numDefinitions != 1 {
+		t.Errorf("wrong number of local definitions. want=1, got=%d",
+			local.numDefinitions)
+	}
+}
+
+func TestSnapshotRestore(t *testing.T) {
+	global := NewSymbolTable()
+	global.Define("a")
+
+	snapshot := global.Snapshot()
+	global.Define("b")
+	global.defineExternal("c")
+	global.defineHidden("d")
+
+	global.Restore(snapshot)
+
+	for _, name := range []string{"b", "c", "d"} {
+		if sym, ok := global.Resolve(name); ok {
+			t.Errorf("%s still defined after restore. got=%+v", name, sym)
+		}
+	}
+	if global.externals != nil || global.hidden != nil {
+		t.Errorf("externals or hidden kept after restore")
+	}
+
+	b := global.Define("b")
+	expected := Symbol{Name: "b", Scope: GlobalScope, Index: 1}
+	if b != expected {
+		t.Errorf("expected %+v, got=%+v", expected, b)
+	}
+}
@@ -0,0 +1,70 @@
+package compiler
+
+// Unit is a separately compiled program. Besides its ByteCode it records
+// the global slots it defines and the ones it expects other units to
+// define, so a linker can merge several units into one program.
+type Unit struct {
+	*ByteCode
+
+	// Globals maps the names of the globals defined by the unit to their slots.
+	Globals map[string]int
+	// Externals maps the names the unit uses without defining them to the
+	// slots they were given in this unit.
+	Externals map[string]int
+	// Imports maps the path of every imported module to its cache slot.
+	Imports map[string]int
+
+	// NumGlobals is the number of global slots used by the unit, including
+	// the unnamed globals of imported modules.
+	NumGlobals int
+}
+
+// AllowExternals compiles undefined names of the main program into
+// external globals instead of reporting them, to be resolved when the
+// unit is linked. Names undefined inside imported modules are still
+// errors.
+func (c *Compiler) AllowExternals() {
+	c.allowExternals = true
+}
+
+// Unit returns the compiled program along with its symbols. Like
+// ByteCode it returns nil if compilation reported any errors.
+func (c *Compiler) Unit() *Unit {
+	byteCode := c.ByteCode()
+	if byteCode == nil {
+		return nil
+	}
+
+	unit := &Unit{
+		ByteCode:   byteCode,
+		Globals:    make(map[string]int),
+		Externals:  make(map[string]int),
+		Imports:    make(map[string]int),
+		NumGlobals: *c.mainSymbolTable.numGlobals,
+	}
+
+	for path, module := range c.mainSymbolTable.modules {
+		unit.Imports[path] = module.slot
+	}
+
+	for _, sym := range c.mainSymbolTable.Globals() {
+		if c.mainSymbolTable.externals[sym.Name] {
+			unit.Externals[sym.Name] = sym.Index
+		} else {
+			unit.Globals[sym.Name] = sym.Index
+		}
+	}
+
+	return unit
+}
+
+// resolve looks name up in the current scope. When externals are allowed,
+// unknown names of the main program become external globals.
+func (c *Compiler) resolve(name string) (Symbol, bool) {
+	symbol, ok := c.symbolTable.Resolve(name)
+	if ok || !c.allowExternals || c.module != "" {
+		return symbol, ok
+	}
+
+	return c.mainSymbolTable.defineExternal(name), true
+}
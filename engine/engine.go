@@ -0,0 +1,160 @@
+// Package engine wires the lexer, parser, compiler and VM together for Go
+// programs that embed Monkey.
+package engine
+
+import (
+	"fmt"
+	"github.com/carmooo/monkey_compiler/compiler"
+	"github.com/carmooo/monkey_compiler/lexer"
+	compilerObject "github.com/carmooo/monkey_compiler/object"
+	"github.com/carmooo/monkey_compiler/parser"
+	"github.com/carmooo/monkey_compiler/vm"
+	"github.com/carmooo/monkey_interpreter/object"
+	"io"
+)
+
+// Options configures an Engine. The zero value gives the same behavior as
+// the REPL.
+type Options struct {
+	// Stdout, if set, replaces the puts builtin with one that prints to
+	// it instead of os.Stdout.
+	Stdout io.Writer
+
+	// Builtins are the builtins available to scripts. Defaults to
+	// NewRegistry. The engine works on a copy, so the registry can be
+	// shared between engines.
+	Builtins *compilerObject.Registry
+
+	// Importer enables import expressions.
+	Importer compiler.Importer
+
+	Limits             vm.Limits
+	CheckedArithmetic  bool
+	RaiseBuiltinErrors bool
+
+	// Scheduling configures how tasks started by spawn are interleaved.
+	Scheduling vm.Scheduling
+}
+
+// Engine evaluates Monkey programs. Globals, constants and definitions
+// persist across calls, so every call sees what earlier calls defined.
+// An Engine is not safe for concurrent use.
+type Engine struct {
+	options  Options
+	builtins *compilerObject.Registry
+
+	constants   []object.Object
+	symbolTable *compiler.SymbolTable
+	globals     []object.Object
+}
+
+func New(options Options) *Engine {
+	builtins := compilerObject.NewRegistry()
+	if options.Builtins != nil {
+		builtins = options.Builtins.Clone()
+	}
+	if _, ok := builtins.Lookup("puts"); ok && options.Stdout != nil {
+		builtins.Register("puts", compilerObject.Variadic, putsTo(options.Stdout))
+	}
+
+	symbolTable := compiler.NewSymbolTable()
+	symbolTable.DefineBuiltins(builtins)
+
+	return &Engine{
+		options:  options,
+		builtins: builtins,
+
+		constants:   []object.Object{},
+		symbolTable: symbolTable,
+		globals:     make([]object.Object, vm.GlobalsSize),
+	}
+}
+
+// Eval compiles and runs src and returns the value of its last statement,
+// which is null for statements without a value.
+func (e *Engine) Eval(src string) (object.Object, error) {
+	byteCode, err := e.Compile(src)
+	if err != nil {
+		return nil, err
+	}
+
+	return e.Run(byteCode)
+}
+
+// Compile compiles src against the definitions of earlier calls. The
+// bytecode can only be run by this engine. If src doesn't compile, none of
+// its definitions are kept.
+func (e *Engine) Compile(src string) (*compiler.ByteCode, error) {
+	p := parser.New(lexer.New(src))
+	program := p.ParseProgram()
+	if len(p.Errors()) > 0 {
+		return nil, &Error{Stage: ParseStage, Err: ParseErrors(p.Errors())}
+	}
+
+	comp := compiler.NewWithState(e.constants, e.symbolTable)
+	if e.options.Importer != nil {
+		comp.SetImporter(e.options.Importer)
+	}
+
+	snapshot := e.symbolTable.Snapshot()
+
+	err := comp.Compile(program)
+	if err != nil {
+		e.symbolTable.Restore(snapshot)
+		return nil, &Error{Stage: CompileStage, Err: err}
+	}
+
+	byteCode := comp.ByteCode()
+	e.constants = byteCode.Constants
+
+	return byteCode, nil
+}
+
+// Run runs bytecode compiled by this engine and returns the value of its
+// last statement.
+func (e *Engine) Run(byteCode *compiler.ByteCode) (object.Object, error) {
+	machine := e.newVM(byteCode)
+
+	result, err := machine.RunProgram()
+	if err != nil {
+		return nil, &Error{Stage: RunStage, Err: err}
+	}
+	return result, nil
+}
+
+// Globals gives access to the engine's global variables by name. Globals
+// set through it can be used by code compiled afterwards.
+func (e *Engine) Globals() *vm.Globals {
+	return vm.NewGlobals(e.symbolTable, e.globals)
+}
+
+// Call calls a function returned by an earlier Eval or Run with args.
+func (e *Engine) Call(fn object.Object, args ...object.Object) (object.Object, error) {
+	machine := e.newVM(&compiler.ByteCode{Constants: e.constants})
+
+	result, err := machine.Call(fn, args...)
+	if err != nil {
+		return nil, &Error{Stage: RunStage, Err: err}
+	}
+	return result, nil
+}
+
+func (e *Engine) newVM(byteCode *compiler.ByteCode) *vm.VM {
+	machine := vm.NewWithGlobalsStore(byteCode, e.globals)
+	machine.SetBuiltins(e.builtins)
+	machine.SetLimits(e.options.Limits)
+	machine.CheckedArithmetic = e.options.CheckedArithmetic
+	machine.RaiseBuiltinErrors = e.options.RaiseBuiltinErrors
+	machine.SetScheduling(e.options.Scheduling)
+
+	return machine
+}
+
+func putsTo(out io.Writer) object.BuiltinFunction {
+	return func(args ...object.Object) object.Object {
+		for _, arg := range args {
+			fmt.Fprintln(out, arg.Inspect())
+		}
+		return nil
+	}
+}
@@ -0,0 +1,273 @@
+package engine
+
+import (
+	"bytes"
+	"errors"
+	"github.com/carmooo/monkey_compiler/compiler"
+	compilerObject "github.com/carmooo/monkey_compiler/object"
+	"github.com/carmooo/monkey_compiler/vm"
+	"github.com/carmooo/monkey_interpreter/object"
+	"strings"
+	"testing"
+)
+
+func TestEval(t *testing.T) {
+	engine := New(Options{})
+
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{`let add = fn(a, b) { a + b };`, "null"},
+		{`let x = add(1, 2);`, "null"},
+		{`x * 10`, "30"},
+		{`let greet = fn(name) { "hello " + name }; greet("monkey")`, "hello monkey"},
+		{`add(x, len([1, 2]))`, "5"},
+		{``, "null"},
+		{`return x + 1; x = 0`, "4"},
+		{`x`, "3"},
+	}
+
+	for _, tt := range tests {
+		result, err := engine.Eval(tt.input)
+		if err != nil {
+			t.Fatalf("eval error: %s", err)
+		}
+		if result == nil {
+			t.Fatalf("eval returned no result for %q", tt.input)
+		}
+		if result.Inspect() != tt.expected {
+			t.Errorf("wrong result for %q. want=%s, got=%s", tt.input, tt.expected, result.Inspect())
+		}
+	}
+}
+
+func TestCompileAndRun(t *testing.T) {
+	engine := New(Options{})
+
+	byteCode, err := engine.Compile(`let counter = [0]; counter`)
+	if err != nil {
+		t.Fatalf("compile error: %s", err)
+	}
+
+	// definitions made by Compile are visible before the bytecode runs
+	next, err := engine.Compile(`len(counter)`)
+	if err != nil {
+		t.Fatalf("compile error: %s", err)
+	}
+
+	_, err = engine.Run(byteCode)
+	if err != nil {
+		t.Fatalf("run error: %s", err)
+	}
+
+	result, err := engine.Run(next)
+	if err != nil {
+		t.Fatalf("run error: %s", err)
+	}
+	if result.Inspect() != "1" {
+		t.Errorf("wrong result. want=1, got=%s", result.Inspect())
+	}
+}
+
+func TestCall(t *testing.T) {
+	engine := New(Options{})
+
+	fn, err := engine.Eval(`let base = 10; fn(x) { base + x }`)
+	if err != nil {
+		t.Fatalf("eval error: %s", err)
+	}
+
+	result, err := engine.Call(fn, &object.Integer{Value: 5})
+	if err != nil {
+		t.Fatalf("call error: %s", err)
+	}
+	if result.Inspect() != "15" {
+		t.Errorf("wrong result. want=15, got=%s", result.Inspect())
+	}
+
+	_, err = engine.Call(fn)
+	if err == nil || err.Error() != "run error: wrong number of arguments: want=1, got=0" {
+		t.Errorf("wrong error. got=%v", err)
+	}
+}
+
+func TestFailedCompileKeepsNoDefinitions(t *testing.T) {
+	engine := New(Options{})
+
+	_, err := engine.Eval(`let x = y;`)
+	if err == nil {
+		t.Fatalf("expected compile error but resulted in none")
+	}
+
+	_, err = engine.Eval(`x`)
+	if err == nil || err.Error() != "compile error: 1:1: undefined variable: x" {
+		t.Errorf("wrong error. got=%v", err)
+	}
+
+	result, err := engine.Eval(`let x = 1; x`)
+	if err != nil {
+		t.Fatalf("eval error: %s", err)
+	}
+	if result.Inspect() != "1" {
+		t.Errorf("wrong result. want=1, got=%s", result.Inspect())
+	}
+	if names := engine.Globals().Names(); len(names) != 1 || names[0] != "x" {
+		t.Errorf("wrong globals. want=[x], got=%v", names)
+	}
+}
+
+func TestGlobals(t *testing.T) {
+	engine := New(Options{})
+	globals := engine.Globals()
+
+	err := globals.Set("limit", &object.Integer{Value: 3})
+	if err != nil {
+		t.Fatalf("set error: %s", err)
+	}
+
+	_, err = engine.Eval(`let result = limit * 2;`)
+	if err != nil {
+		t.Fatalf("eval error: %s", err)
+	}
+
+	result, ok := globals.Get("result")
+	if !ok || result.Inspect() != "6" {
+		t.Errorf("wrong result global. got=%v", result)
+	}
+}
+
+func TestStdout(t *testing.T) {
+	var out bytes.Buffer
+	engine := New(Options{Stdout: &out})
+
+	result, err := engine.Eval(`puts("hello", 1); puts([true])`)
+	if err != nil {
+		t.Fatalf("eval error: %s", err)
+	}
+
+	if out.String() != "hello\n1\n[true]\n" {
+		t.Errorf("wrong output. got=%q", out.String())
+	}
+	if result != vm.Null {
+		t.Errorf("puts did not return null. got=%s", result.Inspect())
+	}
+}
+
+func TestScheduling(t *testing.T) {
+	input := `
+	let worker = fn(name, n) { if (n > 0) { puts(name); worker(name, n - 1) } };
+	spawn(worker, "a", 3);
+	spawn(worker, "b", 3);
+	`
+
+	run := func() string {
+		var out bytes.Buffer
+		engine := New(Options{
+			Stdout:     &out,
+			Scheduling: vm.Scheduling{Deterministic: true, InstructionSlice: 10},
+		})
+
+		_, err := engine.Eval(input)
+		if err != nil {
+			t.Fatalf("eval error: %s", err)
+		}
+		return out.String()
+	}
+
+	first := run()
+	if first != run() {
+		t.Errorf("deterministic runs printed different output")
+	}
+	if strings.Count(first, "a\n") != 3 || strings.Count(first, "b\n") != 3 {
+		t.Errorf("tasks didn't run to completion. got=%q", first)
+	}
+	if strings.HasPrefix(first, "a\na\na\n") {
+		t.Errorf("tasks weren't interleaved. got=%q", first)
+	}
+}
+
+func TestBuiltins(t *testing.T) {
+	builtins := compilerObject.NewRegistry()
+	builtins.Register("double", 1, func(args ...object.Object) object.Object {
+		return &object.Integer{Value: args[0].(*object.Integer).Value * 2}
+	})
+	builtins.Register("len", 1, func(args ...object.Object) object.Object {
+		return &object.Integer{Value: -1}
+	})
+	builtins.Remove("first")
+
+	engine := New(Options{Builtins: builtins})
+
+	result, err := engine.Eval(`double(21) + len([1, 2, 3])`)
+	if err != nil {
+		t.Fatalf("eval error: %s", err)
+	}
+	if result.Inspect() != "41" {
+		t.Errorf("wrong result. want=41, got=%s", result.Inspect())
+	}
+
+	_, err = engine.Eval(`first([1])`)
+	if err == nil || err.Error() != "compile error: 1:1: undefined variable: first" {
+		t.Errorf("removed builtin is still defined. got=%v", err)
+	}
+
+	// the engine works on its own copy of the registry
+	builtins.Remove("double")
+	result, err = engine.Eval(`double(1)`)
+	if err != nil {
+		t.Fatalf("eval error: %s", err)
+	}
+	if result.Inspect() != "2" {
+		t.Errorf("wrong result. want=2, got=%s", result.Inspect())
+	}
+}
+
+func TestErrors(t *testing.T) {
+	tests := []struct {
+		options       Options
+		input         string
+		expectedStage Stage
+		expectedError string
+	}{
+		{Options{}, `let = 1;`, ParseStage,
+			"parse error: expected next token to be IDENT, got = instead.\n" +
+				"no prefix parse function for = found"},
+		{Options{}, `x + y`, CompileStage,
+			"compile error: 1:1: undefined variable: x\n" +
+				"1:5: undefined variable: y"},
+		{Options{}, `1 / 0`, RunStage, "run error: division by zero"},
+		{Options{Limits: vm.Limits{MaxFrames: 8}}, `let f = fn() { f() }; f()`, RunStage,
+			"run error: frame overflow"},
+		{Options{CheckedArithmetic: true}, `9223372036854775807 + 1`, RunStage,
+			"run error: integer overflow: 9223372036854775807 + 1"},
+		{Options{RaiseBuiltinErrors: true}, `len(1) + 1`, RunStage,
+			"run error: error in builtin len in frame 0 at ip 5: argument to `len` not supported, got INTEGER"},
+	}
+
+	for _, tt := range tests {
+		engine := New(tt.options)
+
+		_, err := engine.Eval(tt.input)
+		if err == nil {
+			t.Fatalf("expected error but resulted in none. input=%q", tt.input)
+		}
+
+		var engineErr *Error
+		if !errors.As(err, &engineErr) {
+			t.Fatalf("error is not *Error. got=%T", err)
+		}
+		if engineErr.Stage != tt.expectedStage {
+			t.Errorf("wrong stage. want=%s, got=%s", tt.expectedStage, engineErr.Stage)
+		}
+		if err.Error() != tt.expectedError {
+			t.Errorf("wrong error. want=%q, got=%q", tt.expectedError, err)
+		}
+	}
+
+	_, err := New(Options{}).Eval(`x`)
+	var compileErrors compiler.CompileErrors
+	if !errors.As(err, &compileErrors) || len(compileErrors) != 1 {
+		t.Errorf("compile errors are not unwrapped. got=%v", err)
+	}
+}
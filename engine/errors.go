@@ -0,0 +1,38 @@
+package engine
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Stage is the step of evaluation an error was reported by.
+type Stage string
+
+const (
+	ParseStage   Stage = "parse"
+	CompileStage Stage = "compile"
+	RunStage     Stage = "run"
+)
+
+// Error is returned by every Engine method. Err holds the underlying
+// error: ParseErrors, compiler.CompileErrors, or the runtime error of the
+// VM, which may be a *vm.InternalError.
+type Error struct {
+	Stage Stage
+	Err   error
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s error: %s", e.Stage, e.Err)
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// ParseErrors are the messages reported by the parser.
+type ParseErrors []string
+
+func (errs ParseErrors) Error() string {
+	return strings.Join(errs, "\n")
+}
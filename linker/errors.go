@@ -0,0 +1,28 @@
+package linker
+
+import (
+	"fmt"
+	"strings"
+)
+
+// LinkError is an error found in one of the units given to Link, which
+// are numbered from 1 in the order they were given.
+type LinkError struct {
+	Message string
+	Unit    int
+}
+
+func (e *LinkError) Error() string {
+	return fmt.Sprintf("unit %d: %s", e.Unit+1, e.Message)
+}
+
+// LinkErrors aggregates every error reported by a single Link call.
+type LinkErrors []*LinkError
+
+func (errs LinkErrors) Error() string {
+	messages := make([]string, len(errs))
+	for i, err := range errs {
+		messages[i] = err.Error()
+	}
+	return strings.Join(messages, "\n")
+}
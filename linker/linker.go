@@ -0,0 +1,255 @@
+package linker
+
+import (
+	"fmt"
+	"github.com/carmooo/monkey_compiler/code"
+	"github.com/carmooo/monkey_compiler/compiler"
+	compilerObject "github.com/carmooo/monkey_compiler/object"
+	"github.com/carmooo/monkey_interpreter/object"
+	"sort"
+)
+
+// maxOperand is the largest constant or global index that fits the 2-byte
+// operands of OpConstant, OpClosure, OpImport and the global opcodes.
+const maxOperand = 1<<16 - 1
+
+type definition struct {
+	unit int
+	slot int
+}
+
+// layout tells where the constants and global slots of a unit ended up in
+// the linked program.
+type layout struct {
+	constantOffset int
+	slots          []int
+}
+
+type linker struct {
+	units   []*compiler.Unit
+	layouts []*layout
+
+	constants    []object.Object
+	instructions code.Instructions
+	handlers     []compilerObject.Handler
+	numGlobals   int
+
+	globals map[string]definition
+	imports map[string]int
+
+	errors LinkErrors
+}
+
+// Link merges separately compiled units into a single program whose main
+// instructions run the units in the order given. Constant pools are
+// concatenated, every unit's globals are relocated into one store, and the
+// externals of each unit are resolved against the globals defined by the
+// others. Modules imported by several units share a single cache slot, so
+// they still run once. Duplicate definitions and unresolved externals are
+// reported together as LinkErrors.
+func Link(units ...*compiler.Unit) (*compiler.ByteCode, error) {
+	l := &linker{
+		units:   units,
+		layouts: make([]*layout, len(units)),
+		globals: make(map[string]definition),
+		imports: make(map[string]int),
+	}
+
+	for i := range units {
+		l.allocate(i)
+	}
+	for i := range units {
+		l.resolveExternals(i)
+	}
+
+	if l.numGlobals > maxOperand+1 {
+		l.addError(len(units)-1, "too many globals: %d", l.numGlobals)
+	}
+	if len(l.errors) > 0 {
+		sort.SliceStable(l.errors, func(i, j int) bool {
+			return l.errors[i].Unit < l.errors[j].Unit
+		})
+		return nil, l.errors
+	}
+
+	for i, unit := range units {
+		err := l.link(i, unit)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if len(l.errors) > 0 {
+		return nil, l.errors
+	}
+
+	return &compiler.ByteCode{
+		Instructions: l.instructions,
+		Constants:    l.constants,
+		Handlers:     l.handlers,
+	}, nil
+}
+
+// allocate assigns a slot of the linked program to every global of the
+// unit except its externals, which are resolved once all units are known.
+func (l *linker) allocate(i int) {
+	unit := l.units[i]
+
+	names := make(map[int]string, len(unit.Globals))
+	for name, slot := range unit.Globals {
+		names[slot] = name
+	}
+	imports := make(map[int]string, len(unit.Imports))
+	for path, slot := range unit.Imports {
+		imports[slot] = path
+	}
+	externals := make(map[int]bool, len(unit.Externals))
+	for _, slot := range unit.Externals {
+		externals[slot] = true
+	}
+
+	slots := make([]int, unit.NumGlobals)
+	for slot := range slots {
+		if externals[slot] {
+			continue
+		}
+
+		if path, ok := imports[slot]; ok {
+			if linked, ok := l.imports[path]; ok {
+				slots[slot] = linked
+				continue
+			}
+			slots[slot] = l.newGlobal()
+			l.imports[path] = slots[slot]
+			continue
+		}
+
+		if name, ok := names[slot]; ok {
+			if def, ok := l.globals[name]; ok {
+				l.addError(i, "duplicate definition of %s, first defined in unit %d",
+					name, def.unit+1)
+			}
+			slots[slot] = l.newGlobal()
+			l.globals[name] = definition{unit: i, slot: slots[slot]}
+			continue
+		}
+
+		// unnamed globals of imported modules are private to the unit
+		slots[slot] = l.newGlobal()
+	}
+
+	l.layouts[i] = &layout{slots: slots}
+}
+
+func (l *linker) resolveExternals(i int) {
+	unit := l.units[i]
+
+	names := make([]string, 0, len(unit.Externals))
+	for name := range unit.Externals {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		def, ok := l.globals[name]
+		if !ok {
+			l.addError(i, "undefined symbol: %s", name)
+			continue
+		}
+
+		l.layouts[i].slots[unit.Externals[name]] = def.slot
+	}
+}
+
+// link appends the relocated constants, main instructions and handlers of
+// the unit.
+func (l *linker) link(i int, unit *compiler.Unit) error {
+	layout := l.layouts[i]
+	layout.constantOffset = len(l.constants)
+
+	if layout.constantOffset+len(unit.Constants) > maxOperand+1 {
+		l.addError(i, "too many constants: %d", layout.constantOffset+len(unit.Constants))
+		return nil
+	}
+
+	for _, constant := range unit.Constants {
+		fn, ok := constant.(*compilerObject.CompiledFunction)
+		if !ok {
+			l.constants = append(l.constants, constant)
+			continue
+		}
+
+		instructions, err := relocate(fn.Instructions, layout, 0)
+		if err != nil {
+			return err
+		}
+
+		l.constants = append(l.constants, &compilerObject.CompiledFunction{
+			Instructions:  instructions,
+			NumLocals:     fn.NumLocals,
+			NumParameters: fn.NumParameters,
+			Generator:     fn.Generator,
+			Handlers:      fn.Handlers,
+		})
+	}
+
+	instructions, err := relocate(unit.Instructions, layout, len(l.instructions))
+	if err != nil {
+		return err
+	}
+	for _, h := range unit.Handlers {
+		h.Start += len(l.instructions)
+		h.End += len(l.instructions)
+		h.Target += len(l.instructions)
+		l.handlers = append(l.handlers, h)
+	}
+	l.instructions = append(l.instructions, instructions...)
+
+	return nil
+}
+
+// relocate rewrites the constant and global operands of ins for the linked
+// program and moves jump targets by jumpOffset. The original instructions
+// are left untouched, so a unit can be linked more than once.
+func relocate(ins code.Instructions, layout *layout, jumpOffset int) (code.Instructions, error) {
+	relocated := make(code.Instructions, 0, len(ins))
+
+	for ip := 0; ip < len(ins); {
+		def, err := code.Lookup(ins[ip])
+		if err != nil {
+			return nil, err
+		}
+
+		op := code.Opcode(ins[ip])
+		operands, read := code.ReadOperands(def, ins[ip+1:])
+
+		switch op {
+		case code.OpConstant, code.OpClosure:
+			operands[0] += layout.constantOffset
+		case code.OpImport:
+			operands[0] += layout.constantOffset
+			operands[1] = layout.slots[operands[1]]
+		case code.OpGetGlobal, code.OpSetGlobal:
+			operands[0] = layout.slots[operands[0]]
+		case code.OpJump, code.OpJumpNotTruthy:
+			operands[0] += jumpOffset
+		}
+
+		relocated = append(relocated, code.Make(op, operands...)...)
+		ip += 1 + read
+	}
+
+	return relocated, nil
+}
+
+func (l *linker) newGlobal() int {
+	l.numGlobals++
+	return l.numGlobals - 1
+}
+
+func (l *linker) addError(unit int, format string, a ...interface{}) {
+	l.errors = append(l.errors, &LinkError{
+		Message: fmt.Sprintf(format, a...),
+		Unit:    unit,
+	})
+}
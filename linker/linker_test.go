@@ -0,0 +1,210 @@
+package linker
+
+import (
+	"fmt"
+	"github.com/carmooo/monkey_compiler/code"
+	"github.com/carmooo/monkey_compiler/compiler"
+	"github.com/carmooo/monkey_compiler/lexer"
+	compilerObject "github.com/carmooo/monkey_compiler/object"
+	"github.com/carmooo/monkey_compiler/parser"
+	"github.com/carmooo/monkey_compiler/vm"
+	"github.com/carmooo/monkey_interpreter/object"
+	"testing"
+)
+
+type mapImporter map[string]string
+
+func (mi mapImporter) Resolve(from, path string) (string, error) {
+	return path, nil
+}
+
+func (mi mapImporter) Read(path string) (string, error) {
+	source, ok := mi[path]
+	if !ok {
+		return "", fmt.Errorf("module not found")
+	}
+	return source, nil
+}
+
+func TestLink(t *testing.T) {
+	tests := []struct {
+		units    []string
+		expected interface{}
+	}{
+		{[]string{`let add = fn(a, b) { a + b };`, `add(1, 2)`}, 3},
+		{[]string{`let x = 10;`, `let y = x * 2;`, `x + y`}, 30},
+		{[]string{`let x = 1;`, `if (x > 0) { "positive" } else { "negative" }`}, "positive"},
+		{[]string{`let x = 1; if (x > 1) { 2 };`, `if (x < 1) { 2 } else { x + 1 }`}, 2},
+		{[]string{`let counter = fn() { base + 1 };`, `let base = 41;`, `counter()`}, 42},
+		{[]string{`let f = fn(x) { fn(y) { x + y + z } };`, `let z = 3;`, `f(1)(2)`}, 6},
+		{[]string{`let x = 1;`, `try { throw x } catch (e) { e + 1 } finally { 0 }`}, 2},
+		{[]string{`let a = try { throw 1 } catch (e) { e };`, `a + try { throw 2 } catch (err) { err }`}, 3},
+		{[]string{`let f = fn() { yield(1); yield(2) };`, `let g = f(); next(g); next(g)["value"]`}, 2},
+		{[]string{`let lib = import "lib";`, `let other = import "lib"; other["Add"](1, lib["One"])`}, 2},
+	}
+
+	importer := mapImporter{"lib": `let One = 1; let Add = fn(a, b) { a + b };`}
+
+	for _, tt := range tests {
+		units := make([]*compiler.Unit, len(tt.units))
+		for i, input := range tt.units {
+			units[i] = compileUnit(t, input, importer)
+		}
+
+		// linking must leave the units untouched, so do it twice
+		for i := 0; i < 2; i++ {
+			byteCode, err := Link(units...)
+			if err != nil {
+				t.Fatalf("link error: %s", err)
+			}
+
+			machine := vm.New(byteCode)
+			err = machine.Run()
+			if err != nil {
+				t.Fatalf("vm error: %s", err)
+			}
+
+			testExpectedObject(t, tt.expected, machine.LastPoppedStackElem())
+		}
+	}
+}
+
+func TestLinkRelocation(t *testing.T) {
+	importer := mapImporter{"lib": `let X = 1;`}
+
+	byteCode, err := Link(
+		compileUnit(t, `import "lib"`, importer),
+		compileUnit(t, `let y = 2; import "lib"`, importer),
+	)
+	if err != nil {
+		t.Fatalf("link error: %s", err)
+	}
+
+	expectedInstructions := concat(
+		code.Make(code.OpImport, 2, 0),
+		code.Make(code.OpPop),
+		code.Make(code.OpConstant, 3),
+		code.Make(code.OpSetGlobal, 2),
+		code.Make(code.OpImport, 6, 0),
+		code.Make(code.OpPop),
+	)
+	if byteCode.Instructions.String() != expectedInstructions.String() {
+		t.Errorf("wrong instructions.\nwant=%q\ngot =%q",
+			expectedInstructions, byteCode.Instructions)
+	}
+
+	if len(byteCode.Constants) != 7 {
+		t.Fatalf("wrong number of constants. want=7, got=%d", len(byteCode.Constants))
+	}
+
+	fn, ok := byteCode.Constants[6].(*compilerObject.CompiledFunction)
+	if !ok {
+		t.Fatalf("constant 6 is not a function. got=%T", byteCode.Constants[6])
+	}
+
+	expectedModule := concat(
+		code.Make(code.OpConstant, 4),
+		code.Make(code.OpSetGlobal, 3),
+		code.Make(code.OpConstant, 5),
+		code.Make(code.OpGetGlobal, 3),
+		code.Make(code.OpHash, 2),
+		code.Make(code.OpSetGlobal, 0),
+		code.Make(code.OpGetGlobal, 0),
+		code.Make(code.OpReturnValue),
+	)
+	if fn.Instructions.String() != expectedModule.String() {
+		t.Errorf("wrong module instructions.\nwant=%q\ngot =%q",
+			expectedModule, fn.Instructions)
+	}
+}
+
+func TestLinkErrors(t *testing.T) {
+	tests := []struct {
+		units         []string
+		expectedError string
+	}{
+		{[]string{`let x = 1;`, `let x = 2;`},
+			"unit 2: duplicate definition of x, first defined in unit 1"},
+		{[]string{`let x = 1;`, `y + z`},
+			"unit 2: undefined symbol: y\nunit 2: undefined symbol: z"},
+		{[]string{`let f = fn() { g() };`, `let f = 1;`, `let x = 1; x`, `let x = 2;`},
+			"unit 1: undefined symbol: g\n" +
+				"unit 2: duplicate definition of f, first defined in unit 1\n" +
+				"unit 4: duplicate definition of x, first defined in unit 3"},
+	}
+
+	for _, tt := range tests {
+		units := make([]*compiler.Unit, len(tt.units))
+		for i, input := range tt.units {
+			units[i] = compileUnit(t, input, nil)
+		}
+
+		byteCode, err := Link(units...)
+		if err == nil {
+			t.Fatalf("expected link error but resulted in none.")
+		}
+		if byteCode != nil {
+			t.Errorf("expected no bytecode after link errors")
+		}
+		if err.Error() != tt.expectedError {
+			t.Errorf("wrong link error.\nwant=%q\ngot =%q", tt.expectedError, err)
+		}
+	}
+}
+
+func compileUnit(t *testing.T, input string, importer compiler.Importer) *compiler.Unit {
+	t.Helper()
+
+	p := parser.New(lexer.New(input))
+	program := p.ParseProgram()
+	if len(p.Errors()) > 0 {
+		t.Fatalf("parser errors: %v", p.Errors())
+	}
+
+	comp := compiler.New()
+	comp.AllowExternals()
+	if importer != nil {
+		comp.SetImporter(importer)
+	}
+
+	err := comp.Compile(program)
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	return comp.Unit()
+}
+
+func concat(instructions ...[]byte) code.Instructions {
+	out := code.Instructions{}
+	for _, ins := range instructions {
+		out = append(out, ins...)
+	}
+	return out
+}
+
+func testExpectedObject(t *testing.T, expected interface{}, actual object.Object) {
+	t.Helper()
+
+	switch expected := expected.(type) {
+	case int:
+		integer, ok := actual.(*object.Integer)
+		if !ok {
+			t.Errorf("object is not Integer. got=%T (%+v)", actual, actual)
+			return
+		}
+		if integer.Value != int64(expected) {
+			t.Errorf("object has wrong value. got=%d, want=%d", integer.Value, expected)
+		}
+
+	case string:
+		str, ok := actual.(*object.String)
+		if !ok {
+			t.Errorf("object is not String. got=%T (%+v)", actual, actual)
+			return
+		}
+		if str.Value != expected {
+			t.Errorf("object has wrong value. got=%q, want=%q", str.Value, expected)
+		}
+	}
+}
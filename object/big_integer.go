@@ -0,0 +1,56 @@
+package object
+
+import (
+	"github.com/carmooo/monkey_interpreter/object"
+	"hash/fnv"
+	"math/big"
+)
+
+const (
+	BIG_INTEGER_HASH_KEY = "BIG_INTEGER"
+)
+
+// BigInteger holds integers outside the int64 range. It reports itself as
+// an INTEGER so the promotion is invisible to Monkey programs. Values that
+// fit into an int64 are always represented as *object.Integer instead, see
+// IntegerFromBig.
+type BigInteger struct {
+	Value *big.Int
+}
+
+func (bi *BigInteger) Type() object.ObjectType { return object.INTEGER_OBJECT }
+func (bi *BigInteger) Inspect() string         { return bi.Value.String() }
+func (bi *BigInteger) HashKey() object.HashKey {
+	h := fnv.New64a()
+	h.Write(bi.Value.Bytes())
+	hash := h.Sum64()
+	if bi.Value.Sign() < 0 {
+		hash = ^hash
+	}
+
+	return object.HashKey{
+		Type:  BIG_INTEGER_HASH_KEY,
+		Value: hash,
+	}
+}
+
+// IntegerFromBig returns the canonical Monkey integer for value: an
+// *object.Integer when it fits into an int64, a *BigInteger otherwise.
+func IntegerFromBig(value *big.Int) object.Object {
+	if value.IsInt64() {
+		return &object.Integer{Value: value.Int64()}
+	}
+	return &BigInteger{Value: value}
+}
+
+// ToBig converts an *object.Integer or *BigInteger into a new big.Int.
+func ToBig(o object.Object) (*big.Int, bool) {
+	switch o := o.(type) {
+	case *object.Integer:
+		return big.NewInt(o.Value), true
+	case *BigInteger:
+		return new(big.Int).Set(o.Value), true
+	default:
+		return nil, false
+	}
+}
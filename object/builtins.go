@@ -0,0 +1,182 @@
+package object
+
+import (
+	"fmt"
+	"github.com/carmooo/monkey_interpreter/object"
+	"math"
+	"math/big"
+	"strconv"
+)
+
+type BuiltinDefinition struct {
+	Name string
+	// Builtin is an *object.Builtin or a *HostBuiltin.
+	Builtin object.Object
+	// Arity is the number of arguments the builtin takes, or Variadic.
+	Arity int
+}
+
+// Builtins extends the interpreter's builtins with the ones only the
+// compiler and VM know about. They are the builtins of NewRegistry, in
+// the same order, so entries must only ever be appended.
+var Builtins = concatBuiltins(interpreterBuiltins(), numericBuiltins, higherOrderBuiltins, generatorBuiltins, taskBuiltins)
+
+func concatBuiltins(lists ...[]BuiltinDefinition) []BuiltinDefinition {
+	var builtins []BuiltinDefinition
+	for _, list := range lists {
+		builtins = append(builtins, list...)
+	}
+	return builtins
+}
+
+var interpreterArities = map[string]int{
+	"len":   1,
+	"puts":  Variadic,
+	"first": 1,
+	"last":  1,
+	"rest":  1,
+	"push":  2,
+}
+
+func interpreterBuiltins() []BuiltinDefinition {
+	builtins := make([]BuiltinDefinition, 0, len(object.Builtins))
+	for _, def := range object.Builtins {
+		arity, ok := interpreterArities[def.Name]
+		if !ok {
+			arity = Variadic
+		}
+
+		builtins = append(builtins, BuiltinDefinition{
+			Name:    def.Name,
+			Builtin: def.Builtin,
+			Arity:   arity,
+		})
+	}
+	return builtins
+}
+
+var numericBuiltins = []BuiltinDefinition{
+	{
+		"int",
+		&object.Builtin{
+			Fn: func(args ...object.Object) object.Object {
+				if len(args) != 1 {
+					return newError("wrong number of arguments. got=%d, want=1", len(args))
+				}
+				switch arg := args[0].(type) {
+				case *object.Integer:
+					return arg
+				case *Float:
+					return floatToInteger("int", math.Trunc(arg.Value))
+				case *BigInteger:
+					return arg
+				case *object.String:
+					value, ok := new(big.Int).SetString(arg.Value, 0)
+					if !ok {
+						return newError("could not parse %q as integer", arg.Value)
+					}
+					return IntegerFromBig(value)
+				default:
+					return newError("argument to `int` not supported, got %s", arg.Type())
+				}
+			},
+		},
+		1,
+	},
+	{
+		"float",
+		&object.Builtin{
+			Fn: func(args ...object.Object) object.Object {
+				if len(args) != 1 {
+					return newError("wrong number of arguments. got=%d, want=1", len(args))
+				}
+				switch arg := args[0].(type) {
+				case *object.Integer:
+					return &Float{Value: float64(arg.Value)}
+				case *BigInteger:
+					value, _ := new(big.Float).SetInt(arg.Value).Float64()
+					return &Float{Value: value}
+				case *Float:
+					return arg
+				case *object.String:
+					value, err := strconv.ParseFloat(arg.Value, 64)
+					if err != nil {
+						return newError("could not parse %q as float", arg.Value)
+					}
+					return &Float{Value: value}
+				default:
+					return newError("argument to `float` not supported, got %s", arg.Type())
+				}
+			},
+		},
+		1,
+	},
+	{
+		"round",
+		&object.Builtin{
+			Fn: func(args ...object.Object) object.Object {
+				if len(args) != 1 {
+					return newError("wrong number of arguments. got=%d, want=1", len(args))
+				}
+				switch arg := args[0].(type) {
+				case *object.Integer, *BigInteger:
+					return arg
+				case *Float:
+					return floatToInteger("round", math.Round(arg.Value))
+				default:
+					return newError("argument to `round` not supported, got %s", arg.Type())
+				}
+			},
+		},
+		1,
+	},
+	{
+		"floor",
+		&object.Builtin{
+			Fn: func(args ...object.Object) object.Object {
+				if len(args) != 1 {
+					return newError("wrong number of arguments. got=%d, want=1", len(args))
+				}
+				switch arg := args[0].(type) {
+				case *object.Integer, *BigInteger:
+					return arg
+				case *Float:
+					return floatToInteger("floor", math.Floor(arg.Value))
+				default:
+					return newError("argument to `floor` not supported, got %s", arg.Type())
+				}
+			},
+		},
+		1,
+	},
+}
+
+func floatToInteger(name string, value float64) object.Object {
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		return newError("argument to `%s` out of integer range, got %s",
+			name, (&Float{Value: value}).Inspect())
+	}
+	if math.MinInt64 <= value && value < math.MaxInt64 {
+		return &object.Integer{Value: int64(value)}
+	}
+
+	integer, _ := big.NewFloat(value).Int(nil)
+	return IntegerFromBig(integer)
+}
+
+func newError(format string, a ...interface{}) *object.Error {
+	return &object.Error{Message: fmt.Sprintf(format, a...)}
+}
+
+// IsTruthy reports whether o counts as true in a condition. Only false and
+// null, or a missing value, are false.
+func IsTruthy(o object.Object) bool {
+	switch o := o.(type) {
+	case *object.Boolean:
+		return o.Value
+	case *object.Null, nil:
+		return false
+	default:
+		return true
+	}
+}
@@ -7,14 +7,50 @@ import (
 
 const (
 	CLOSURE_OBJECT = "CLOSURE_OBJECT"
+	UPVALUE_OBJECT = "UPVALUE_OBJECT"
 )
 
 type Closure struct {
 	Fn            *CompiledFunction
-	FreeVariables []object.Object
+	FreeVariables []*Upvalue
 }
 
 func (c *Closure) Type() object.ObjectType { return CLOSURE_OBJECT }
 func (c *Closure) Inspect() string {
 	return fmt.Sprintf("Closure[%p]", c)
 }
+
+// Upvalue is a variable captured by a closure. While the frame that owns
+// the variable is running the upvalue is open and points at its stack
+// slot, so reads and writes on either side are shared. When the frame
+// returns the upvalue is closed and keeps the value itself.
+type Upvalue struct {
+	location *object.Object
+	closed   object.Object
+}
+
+func NewOpenUpvalue(slot *object.Object) *Upvalue {
+	return &Upvalue{location: slot}
+}
+
+func (u *Upvalue) Get() object.Object  { return *u.location }
+func (u *Upvalue) Set(o object.Object) { *u.location = o }
+
+func (u *Upvalue) Close() {
+	u.closed = *u.location
+	u.location = &u.closed
+}
+
+// Reopen points a closed upvalue at slot again, moving its value there.
+// Generators use it to give the upvalues of their frame back their stack
+// slots when they resume.
+func (u *Upvalue) Reopen(slot *object.Object) {
+	*slot = u.closed
+	u.closed = nil
+	u.location = slot
+}
+
+func (u *Upvalue) Type() object.ObjectType { return UPVALUE_OBJECT }
+func (u *Upvalue) Inspect() string {
+	return fmt.Sprintf("Upvalue[%p]", u)
+}
@@ -14,6 +14,23 @@ type CompiledFunction struct {
 	Instructions  code.Instructions
 	NumLocals     int
 	NumParameters int
+
+	// Generator is set for functions that yield. Calling them returns a
+	// *Generator instead of running them.
+	Generator bool
+
+	// Handlers is the exception table of the function, innermost first.
+	Handlers []Handler
+}
+
+// Handler catches the errors raised while the ip of a frame is in
+// [Start, End). Execution continues at Target with the thrown value pushed
+// on top of the locals and the first Depth operands of the frame.
+type Handler struct {
+	Start  int
+	End    int
+	Target int
+	Depth  int
 }
 
 func (cf *CompiledFunction) Type() object.ObjectType {
@@ -0,0 +1,61 @@
+package object
+
+import (
+	"github.com/carmooo/monkey_interpreter/object"
+	"math"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+const (
+	FLOAT_OBJECT = "FLOAT"
+)
+
+type Float struct {
+	Value float64
+}
+
+func (f *Float) Type() object.ObjectType { return FLOAT_OBJECT }
+func (f *Float) Inspect() string {
+	s := strconv.FormatFloat(f.Value, 'g', -1, 64)
+	// keep floats distinguishable from integers when printed
+	if !strings.ContainsAny(s, ".eIN") {
+		s += ".0"
+	}
+	return s
+}
+
+// HashKey agrees with equality: a whole float hashes like the integer it
+// equals, so 1 and 1.0 are the same hash key, and -0.0 hashes like 0.
+func (f *Float) HashKey() object.HashKey {
+	if f.Value == math.Trunc(f.Value) && !math.IsInf(f.Value, 0) {
+		if f.Value >= math.MinInt64 && f.Value < math.MaxInt64 {
+			return (&object.Integer{Value: int64(f.Value)}).HashKey()
+		}
+
+		whole, _ := big.NewFloat(f.Value).Int(nil)
+		return (&BigInteger{Value: whole}).HashKey()
+	}
+
+	return object.HashKey{
+		Type:  f.Type(),
+		Value: math.Float64bits(f.Value),
+	}
+}
+
+// ToFloat converts an *object.Integer, *BigInteger or *Float into a
+// float64.
+func ToFloat(o object.Object) (float64, bool) {
+	switch o := o.(type) {
+	case *Float:
+		return o.Value, true
+	case *object.Integer:
+		return float64(o.Value), true
+	case *BigInteger:
+		f, _ := new(big.Float).SetInt(o.Value).Float64()
+		return f, true
+	default:
+		return 0, false
+	}
+}
@@ -0,0 +1,66 @@
+package object
+
+import (
+	"fmt"
+	"github.com/carmooo/monkey_interpreter/object"
+)
+
+const (
+	GENERATOR_OBJECT = "GENERATOR_OBJECT"
+)
+
+type GeneratorState int
+
+const (
+	// GeneratorSuspended is the state of a generator that hasn't started
+	// yet or is waiting at a yield.
+	GeneratorSuspended GeneratorState = iota
+	GeneratorRunning
+	GeneratorDone
+)
+
+// Generator is a call to a generator function, a function that yields.
+// Calling the function creates the generator without running it, and each
+// resume runs its frame until the next yield. While it is suspended the
+// generator keeps the frame's locals and operands, and the upvalues that
+// closures created by the frame captured from them.
+type Generator struct {
+	Closure *Closure
+	State   GeneratorState
+
+	// Stack holds the locals and operands of the suspended frame.
+	Stack []object.Object
+	// Ip is the position of the last instruction the frame executed.
+	Ip int
+	// Upvalues are the captured slots of Stack, closed while suspended.
+	Upvalues []SuspendedUpvalue
+}
+
+// SuspendedUpvalue is an upvalue captured from the slot at Offset in the
+// stack of a suspended generator.
+type SuspendedUpvalue struct {
+	Offset  int
+	Upvalue *Upvalue
+}
+
+func NewGenerator(cl *Closure, args []object.Object) *Generator {
+	stack := make([]object.Object, cl.Fn.NumLocals)
+	copy(stack, args)
+
+	return &Generator{Closure: cl, Stack: stack, Ip: -1}
+}
+
+// Started reports whether the generator has run up to a yield at least once.
+func (g *Generator) Started() bool { return g.Ip >= 0 }
+
+// Finish drops the state of a generator that returned or failed.
+func (g *Generator) Finish() {
+	g.State = GeneratorDone
+	g.Stack = nil
+	g.Upvalues = nil
+}
+
+func (g *Generator) Type() object.ObjectType { return GENERATOR_OBJECT }
+func (g *Generator) Inspect() string {
+	return fmt.Sprintf("Generator[%p]", g)
+}
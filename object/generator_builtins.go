@@ -0,0 +1,64 @@
+package object
+
+import (
+	"github.com/carmooo/monkey_interpreter/object"
+)
+
+// generatorBuiltins resume generators through the VM. Both return an
+// IterationResult with the value the generator yielded or returned.
+var generatorBuiltins = []BuiltinDefinition{
+	{
+		"next",
+		&HostBuiltin{
+			Fn: func(caller Caller, args ...object.Object) (object.Object, error) {
+				if len(args) != 1 {
+					return newError("wrong number of arguments. got=%d, want=1", len(args)), nil
+				}
+				return resumeGenerator(caller, "next", args[0])
+			},
+		},
+		1,
+	},
+	{
+		"resume",
+		&HostBuiltin{
+			Fn: func(caller Caller, args ...object.Object) (object.Object, error) {
+				if len(args) != 2 {
+					return newError("wrong number of arguments. got=%d, want=2", len(args)), nil
+				}
+				return resumeGenerator(caller, "resume", args[0], args[1])
+			},
+		},
+		2,
+	},
+}
+
+// resumeGenerator runs the generator until it yields or returns. The value
+// becomes the result of the yield the generator is waiting at, and is
+// dropped if it hasn't started yet.
+func resumeGenerator(caller Caller, name string, generator object.Object, value ...object.Object) (object.Object, error) {
+	gen, ok := generator.(*Generator)
+	if !ok {
+		return newError("argument to `%s` must be GENERATOR, got %s", name, generator.Type()), nil
+	}
+
+	result, err := caller.Call(gen, value...)
+	if err != nil {
+		return nil, err
+	}
+
+	return IterationResult(result, gen.State == GeneratorDone), nil
+}
+
+// IterationResult is the hash that builtins producing a sequence of values
+// return for each of them: the value under "value" and whether the
+// sequence has ended under "done".
+func IterationResult(value object.Object, done bool) *object.Hash {
+	valueKey := &object.String{Value: "value"}
+	doneKey := &object.String{Value: "done"}
+
+	return &object.Hash{Pairs: map[object.HashKey]object.HashPair{
+		valueKey.HashKey(): {Key: valueKey, Value: value},
+		doneKey.HashKey():  {Key: doneKey, Value: &object.Boolean{Value: done}},
+	}}
+}
@@ -0,0 +1,308 @@
+package object
+
+import (
+	"github.com/carmooo/monkey_interpreter/object"
+	"sort"
+)
+
+// higherOrderBuiltins call the Monkey functions they are given through the
+// VM instead of rebuilding arrays with rest and push in Monkey.
+var higherOrderBuiltins = []BuiltinDefinition{
+	{
+		"map",
+		&HostBuiltin{
+			Fn: func(caller Caller, args ...object.Object) (object.Object, error) {
+				elements, fn, err := arrayAndFunction("map", args)
+				if err != nil {
+					return err, nil
+				}
+
+				result := make([]object.Object, len(elements))
+				for i, element := range elements {
+					value, callErr := caller.Call(fn, element)
+					if callErr != nil {
+						return nil, callErr
+					}
+					result[i] = value
+				}
+				return &object.Array{Elements: result}, nil
+			},
+		},
+		2,
+	},
+	{
+		"filter",
+		&HostBuiltin{
+			Fn: func(caller Caller, args ...object.Object) (object.Object, error) {
+				elements, fn, err := arrayAndFunction("filter", args)
+				if err != nil {
+					return err, nil
+				}
+
+				result := []object.Object{}
+				for _, element := range elements {
+					keep, callErr := caller.Call(fn, element)
+					if callErr != nil {
+						return nil, callErr
+					}
+					if IsTruthy(keep) {
+						result = append(result, element)
+					}
+				}
+				return &object.Array{Elements: result}, nil
+			},
+		},
+		2,
+	},
+	{
+		"reduce",
+		&HostBuiltin{
+			Fn: func(caller Caller, args ...object.Object) (object.Object, error) {
+				if len(args) != 3 {
+					return newError("wrong number of arguments. got=%d, want=3", len(args)), nil
+				}
+				elements, fn, err := arrayAndFunction("reduce", []object.Object{args[0], args[2]})
+				if err != nil {
+					return err, nil
+				}
+
+				accumulator := args[1]
+				for _, element := range elements {
+					value, callErr := caller.Call(fn, accumulator, element)
+					if callErr != nil {
+						return nil, callErr
+					}
+					accumulator = value
+				}
+				return accumulator, nil
+			},
+		},
+		3,
+	},
+	{
+		"each",
+		&HostBuiltin{
+			Fn: func(caller Caller, args ...object.Object) (object.Object, error) {
+				elements, fn, err := arrayAndFunction("each", args)
+				if err != nil {
+					return err, nil
+				}
+
+				for _, element := range elements {
+					_, callErr := caller.Call(fn, element)
+					if callErr != nil {
+						return nil, callErr
+					}
+				}
+				return nil, nil
+			},
+		},
+		2,
+	},
+	{
+		"any",
+		&HostBuiltin{
+			Fn: func(caller Caller, args ...object.Object) (object.Object, error) {
+				elements, fn, err := arrayAndFunction("any", args)
+				if err != nil {
+					return err, nil
+				}
+
+				index, callErr := findIndex(caller, elements, fn)
+				if callErr != nil {
+					return nil, callErr
+				}
+				return &object.Boolean{Value: index >= 0}, nil
+			},
+		},
+		2,
+	},
+	{
+		"all",
+		&HostBuiltin{
+			Fn: func(caller Caller, args ...object.Object) (object.Object, error) {
+				elements, fn, err := arrayAndFunction("all", args)
+				if err != nil {
+					return err, nil
+				}
+
+				for _, element := range elements {
+					value, callErr := caller.Call(fn, element)
+					if callErr != nil {
+						return nil, callErr
+					}
+					if !IsTruthy(value) {
+						return &object.Boolean{Value: false}, nil
+					}
+				}
+				return &object.Boolean{Value: true}, nil
+			},
+		},
+		2,
+	},
+	{
+		"find",
+		&HostBuiltin{
+			Fn: func(caller Caller, args ...object.Object) (object.Object, error) {
+				elements, fn, err := arrayAndFunction("find", args)
+				if err != nil {
+					return err, nil
+				}
+
+				index, callErr := findIndex(caller, elements, fn)
+				if callErr != nil || index < 0 {
+					return nil, callErr
+				}
+				return elements[index], nil
+			},
+		},
+		2,
+	},
+	{
+		"sort_by",
+		&HostBuiltin{
+			Fn: func(caller Caller, args ...object.Object) (object.Object, error) {
+				elements, fn, err := arrayAndFunction("sort_by", args)
+				if err != nil {
+					return err, nil
+				}
+
+				keys := make([]object.Object, len(elements))
+				for i, element := range elements {
+					key, callErr := caller.Call(fn, element)
+					if callErr != nil {
+						return nil, callErr
+					}
+					if !comparableKeys(key, key) {
+						return newError("keys of `sort_by` must be numbers or strings, got %s",
+							key.Type()), nil
+					}
+					if i > 0 && !comparableKeys(keys[0], key) {
+						return newError("keys of `sort_by` must all be numbers or all be strings, got %s and %s",
+							keys[0].Type(), key.Type()), nil
+					}
+					keys[i] = key
+				}
+
+				order := make([]int, len(elements))
+				for i := range order {
+					order[i] = i
+				}
+				sort.SliceStable(order, func(i, j int) bool {
+					return compareKeys(keys[order[i]], keys[order[j]]) < 0
+				})
+
+				result := make([]object.Object, len(elements))
+				for i, index := range order {
+					result[i] = elements[index]
+				}
+				return &object.Array{Elements: result}, nil
+			},
+		},
+		2,
+	},
+}
+
+// arrayAndFunction validates the (array, function) arguments shared by the
+// higher-order builtins.
+func arrayAndFunction(name string, args []object.Object) ([]object.Object, object.Object, *object.Error) {
+	if len(args) != 2 {
+		return nil, nil, newError("wrong number of arguments. got=%d, want=2", len(args))
+	}
+
+	array, ok := args[0].(*object.Array)
+	if !ok {
+		return nil, nil, newError("argument to `%s` must be ARRAY, got %s", name, args[0].Type())
+	}
+
+	switch args[1].(type) {
+	case *Closure, *object.Builtin, *HostBuiltin:
+	default:
+		return nil, nil, newError("argument to `%s` must be a function, got %s", name, args[1].Type())
+	}
+
+	return array.Elements, args[1], nil
+}
+
+// findIndex returns the index of the first element for which fn returns a
+// truthy value, or -1.
+func findIndex(caller Caller, elements []object.Object, fn object.Object) (int, error) {
+	for i, element := range elements {
+		value, err := caller.Call(fn, element)
+		if err != nil {
+			return -1, err
+		}
+		if IsTruthy(value) {
+			return i, nil
+		}
+	}
+	return -1, nil
+}
+
+// comparableKeys reports whether sort_by can order the two keys, which
+// holds for two numbers or two strings.
+func comparableKeys(a, b object.Object) bool {
+	switch {
+	case isNumber(a) && isNumber(b):
+		return true
+	case a.Type() == object.STRING_OBJECT && b.Type() == object.STRING_OBJECT:
+		return true
+	default:
+		return false
+	}
+}
+
+func isNumber(o object.Object) bool {
+	switch o.(type) {
+	case *object.Integer, *BigInteger, *Float:
+		return true
+	default:
+		return false
+	}
+}
+
+func compareKeys(a, b object.Object) int {
+	switch a := a.(type) {
+	case *object.String:
+		b := b.(*object.String)
+		switch {
+		case a.Value < b.Value:
+			return -1
+		case a.Value > b.Value:
+			return 1
+		default:
+			return 0
+		}
+
+	case *object.Integer:
+		if b, ok := b.(*object.Integer); ok {
+			switch {
+			case a.Value < b.Value:
+				return -1
+			case a.Value > b.Value:
+				return 1
+			default:
+				return 0
+			}
+		}
+	}
+
+	_, aFloat := a.(*Float)
+	_, bFloat := b.(*Float)
+	if aFloat || bFloat {
+		aValue, _ := ToFloat(a)
+		bValue, _ := ToFloat(b)
+		switch {
+		case aValue < bValue:
+			return -1
+		case aValue > bValue:
+			return 1
+		default:
+			return 0
+		}
+	}
+
+	aBig, _ := ToBig(a)
+	bBig, _ := ToBig(b)
+	return aBig.Cmp(bBig)
+}
@@ -0,0 +1,24 @@
+package object
+
+import (
+	"github.com/carmooo/monkey_interpreter/object"
+)
+
+// Caller calls Monkey functions, closures as well as builtins, from Go.
+// The VM implements it.
+type Caller interface {
+	Call(fn object.Object, args ...object.Object) (object.Object, error)
+}
+
+// HostFunction is a builtin that can call back into the VM running it.
+// Like any builtin it reports bad arguments by returning an *object.Error
+// value, while a non-nil error aborts the program, which is how runtime
+// errors of the functions it calls are propagated.
+type HostFunction func(caller Caller, args ...object.Object) (object.Object, error)
+
+type HostBuiltin struct {
+	Fn HostFunction
+}
+
+func (hb *HostBuiltin) Type() object.ObjectType { return object.BUILTIN_OBJECT }
+func (hb *HostBuiltin) Inspect() string         { return "builtin function" }
@@ -0,0 +1,152 @@
+package object
+
+import (
+	"fmt"
+	"github.com/carmooo/monkey_interpreter/object"
+)
+
+// Variadic is the arity of builtins that take any number of arguments.
+const Variadic = -1
+
+// MaxBuiltins is the number of builtins a registry can hold, bounded by
+// the 1-byte operand of OpGetBuiltin.
+const MaxBuiltins = 256
+
+// Registry holds the builtins available to a program. A builtin keeps its
+// index for the lifetime of the registry, even when it is replaced or
+// removed, so bytecode compiled against the registry stays valid. The
+// compiler and every VM running its bytecode must use the same registry.
+type Registry struct {
+	// removed builtins leave a definition with a nil Builtin behind
+	definitions []BuiltinDefinition
+	indexes     map[string]int
+}
+
+// NewRegistry returns a registry holding the default Builtins.
+func NewRegistry() *Registry {
+	r := NewEmptyRegistry()
+	for _, def := range Builtins {
+		r.define(def)
+	}
+	return r
+}
+
+func NewEmptyRegistry() *Registry {
+	return &Registry{indexes: make(map[string]int)}
+}
+
+// Register makes fn available to scripts under name, replacing any
+// builtin with the same name. Calls with a number of arguments other than
+// arity return an error value without calling fn.
+func (r *Registry) Register(name string, arity int, fn object.BuiltinFunction) error {
+	builtin := fn
+	if arity != Variadic {
+		builtin = func(args ...object.Object) object.Object {
+			if len(args) != arity {
+				return newError("wrong number of arguments. got=%d, want=%d", len(args), arity)
+			}
+			return fn(args...)
+		}
+	}
+
+	return r.define(BuiltinDefinition{
+		Name:    name,
+		Builtin: &object.Builtin{Fn: builtin},
+		Arity:   arity,
+	})
+}
+
+// RegisterHost is like Register for builtins that call the Monkey
+// functions they are given.
+func (r *Registry) RegisterHost(name string, arity int, fn HostFunction) error {
+	builtin := fn
+	if arity != Variadic {
+		builtin = func(caller Caller, args ...object.Object) (object.Object, error) {
+			if len(args) != arity {
+				return newError("wrong number of arguments. got=%d, want=%d", len(args), arity), nil
+			}
+			return fn(caller, args...)
+		}
+	}
+
+	return r.define(BuiltinDefinition{
+		Name:    name,
+		Builtin: &HostBuiltin{Fn: builtin},
+		Arity:   arity,
+	})
+}
+
+func (r *Registry) define(def BuiltinDefinition) error {
+	if index, ok := r.indexes[def.Name]; ok {
+		r.definitions[index] = def
+		return nil
+	}
+
+	if len(r.definitions) >= MaxBuiltins {
+		return fmt.Errorf("cannot register %s: too many builtins", def.Name)
+	}
+
+	r.indexes[def.Name] = len(r.definitions)
+	r.definitions = append(r.definitions, def)
+
+	return nil
+}
+
+// Remove makes the builtin unavailable to programs compiled afterwards.
+// It reports whether a builtin with that name was registered.
+func (r *Registry) Remove(name string) bool {
+	index, ok := r.indexes[name]
+	if !ok {
+		return false
+	}
+
+	delete(r.indexes, name)
+	r.definitions[index] = BuiltinDefinition{}
+
+	return true
+}
+
+func (r *Registry) Lookup(name string) (BuiltinDefinition, bool) {
+	index, ok := r.indexes[name]
+	if !ok {
+		return BuiltinDefinition{}, false
+	}
+	return r.definitions[index], true
+}
+
+// NameOf returns the name builtin is registered under.
+func (r *Registry) NameOf(builtin object.Object) (string, bool) {
+	for _, def := range r.definitions {
+		if def.Builtin != nil && def.Builtin == builtin {
+			return def.Name, true
+		}
+	}
+	return "", false
+}
+
+// Get returns the builtin at index, which is false if it was removed.
+func (r *Registry) Get(index int) (BuiltinDefinition, bool) {
+	if index < 0 || index >= len(r.definitions) || r.definitions[index].Builtin == nil {
+		return BuiltinDefinition{}, false
+	}
+	return r.definitions[index], true
+}
+
+// Len returns the number of indexes in use, including removed builtins.
+func (r *Registry) Len() int {
+	return len(r.definitions)
+}
+
+func (r *Registry) Clone() *Registry {
+	clone := &Registry{
+		definitions: make([]BuiltinDefinition, len(r.definitions)),
+		indexes:     make(map[string]int, len(r.indexes)),
+	}
+
+	copy(clone.definitions, r.definitions)
+	for name, index := range r.indexes {
+		clone.indexes[name] = index
+	}
+
+	return clone
+}
@@ -0,0 +1,98 @@
+package object
+
+import (
+	"github.com/carmooo/monkey_interpreter/object"
+)
+
+// Scheduler runs Monkey functions as concurrent tasks that pass values to
+// each other over channels. The VM implements it, and the task builtins
+// reach it through their Caller. Like builtins, its methods report bad
+// arguments by returning an *object.Error value.
+type Scheduler interface {
+	// Spawn starts calling fn with args in a new task and returns Null.
+	Spawn(fn object.Object, args ...object.Object) (object.Object, error)
+	// NewChannel returns a channel buffering up to capacity values.
+	NewChannel(capacity int) object.Object
+	// Send blocks until the channel takes value.
+	Send(channel, value object.Object) (object.Object, error)
+	// Receive blocks until the channel has a value or is closed, and
+	// returns an IterationResult that is done once it is closed.
+	Receive(channel object.Object) (object.Object, error)
+	// Close closes the channel, waking the tasks blocked on it.
+	Close(channel object.Object) (object.Object, error)
+}
+
+var taskBuiltins = []BuiltinDefinition{
+	{
+		"spawn",
+		schedulerBuiltin("spawn", func(s Scheduler, args []object.Object) (object.Object, error) {
+			if len(args) < 1 {
+				return newError("wrong number of arguments. got=%d, want at least 1", len(args)), nil
+			}
+			return s.Spawn(args[0], args[1:]...)
+		}),
+		Variadic,
+	},
+	{
+		"channel",
+		schedulerBuiltin("channel", func(s Scheduler, args []object.Object) (object.Object, error) {
+			switch len(args) {
+			case 0:
+				return s.NewChannel(0), nil
+			case 1:
+				capacity, ok := args[0].(*object.Integer)
+				if !ok || capacity.Value < 0 {
+					return newError("argument to `channel` must be a non-negative INTEGER, got %s", args[0].Inspect()), nil
+				}
+				return s.NewChannel(int(capacity.Value)), nil
+			default:
+				return newError("wrong number of arguments. got=%d, want=0 or 1", len(args)), nil
+			}
+		}),
+		Variadic,
+	},
+	{
+		"send",
+		schedulerBuiltin("send", func(s Scheduler, args []object.Object) (object.Object, error) {
+			if len(args) != 2 {
+				return newError("wrong number of arguments. got=%d, want=2", len(args)), nil
+			}
+			return s.Send(args[0], args[1])
+		}),
+		2,
+	},
+	{
+		"receive",
+		schedulerBuiltin("receive", func(s Scheduler, args []object.Object) (object.Object, error) {
+			if len(args) != 1 {
+				return newError("wrong number of arguments. got=%d, want=1", len(args)), nil
+			}
+			return s.Receive(args[0])
+		}),
+		1,
+	},
+	{
+		"close",
+		schedulerBuiltin("close", func(s Scheduler, args []object.Object) (object.Object, error) {
+			if len(args) != 1 {
+				return newError("wrong number of arguments. got=%d, want=1", len(args)), nil
+			}
+			return s.Close(args[0])
+		}),
+		1,
+	},
+}
+
+// schedulerBuiltin wraps fn in a builtin that runs it with the scheduler of
+// the VM calling it.
+func schedulerBuiltin(name string, fn func(s Scheduler, args []object.Object) (object.Object, error)) *HostBuiltin {
+	return &HostBuiltin{
+		Fn: func(caller Caller, args ...object.Object) (object.Object, error) {
+			scheduler, ok := caller.(Scheduler)
+			if !ok {
+				return newError("`%s` needs a VM that can run tasks", name), nil
+			}
+			return fn(scheduler, args)
+		},
+	}
+}
@@ -4,10 +4,11 @@ import (
 	"bufio"
 	"fmt"
 	"github.com/carmooo/monkey_compiler/compiler"
+	"github.com/carmooo/monkey_compiler/lexer"
+	compilerObject "github.com/carmooo/monkey_compiler/object"
+	"github.com/carmooo/monkey_compiler/parser"
 	"github.com/carmooo/monkey_compiler/vm"
-	"github.com/carmooo/monkey_interpreter/lexer"
 	"github.com/carmooo/monkey_interpreter/object"
-	"github.com/carmooo/monkey_interpreter/parser"
 	"io"
 )
 
@@ -18,10 +19,9 @@ func Start(in io.Reader, out io.Writer) {
 
 	var constants []object.Object
 	globals := make([]object.Object, vm.GlobalsSize)
+	builtins := compilerObject.NewRegistry()
 	symbolTable := compiler.NewSymbolTable()
-	for i, v := range object.Builtins {
-		symbolTable.DefineBuiltin(i, v.Name)
-	}
+	symbolTable.DefineBuiltins(builtins)
 
 	for {
 		fmt.Printf(PROMPT)
@@ -41,20 +41,26 @@ func Start(in io.Reader, out io.Writer) {
 		}
 
 		comp := compiler.NewWithState(constants, symbolTable)
+		comp.SetImporter(compiler.FileImporter{Root: "."})
+		snapshot := symbolTable.Snapshot()
 		err := comp.Compile(program)
 		if err != nil {
+			symbolTable.Restore(snapshot)
 			fmt.Fprintf(out, "Woops! Compilation failed:\n %s\n", err)
 			continue
 		}
 
-		machine := vm.NewWithGlobalsStore(comp.ByteCode(), globals)
-		err = machine.Run()
+		byteCode := comp.ByteCode()
+		constants = byteCode.Constants
+
+		machine := vm.NewWithGlobalsStore(byteCode, globals)
+		machine.SetBuiltins(builtins)
+		result, err := machine.RunProgram()
 		if err != nil {
 			fmt.Fprintf(out, "Woops! Executing bytecode failed:\n %s\n", err)
 			continue
 		}
-		lastPopped := machine.LastPoppedStackElem()
-		io.WriteString(out, lastPopped.Inspect())
+		io.WriteString(out, result.Inspect())
 		io.WriteString(out, "\n")
 	}
 }
@@ -0,0 +1,112 @@
+package vm
+
+import (
+	"errors"
+	"fmt"
+	"github.com/carmooo/monkey_compiler/code"
+	"github.com/carmooo/monkey_interpreter/object"
+)
+
+// InternalError reports a failure inside the VM itself, such as a Go
+// runtime panic, together with the instruction that was executing.
+type InternalError struct {
+	Cause interface{}
+
+	FramesIndex int
+	Ip          int
+	Opcode      code.Opcode
+}
+
+func (e *InternalError) Error() string {
+	name := fmt.Sprintf("%d", e.Opcode)
+	if def, err := code.Lookup(byte(e.Opcode)); err == nil {
+		name = def.Name
+	}
+
+	return fmt.Sprintf("internal error in frame %d at ip %d (%s): %v",
+		e.FramesIndex, e.Ip, name, e.Cause)
+}
+
+func (vm *VM) newInternalError(cause interface{}, ip int, op code.Opcode) *InternalError {
+	return &InternalError{
+		Cause:       cause,
+		FramesIndex: vm.framesIndex - 1,
+		Ip:          ip,
+		Opcode:      op,
+	}
+}
+
+// BuiltinError reports an error value returned by a builtin while
+// RaiseBuiltinErrors is set, together with the call that returned it.
+type BuiltinError struct {
+	Builtin string
+	Message string
+
+	FramesIndex int
+	Ip          int
+}
+
+func (e *BuiltinError) Error() string {
+	return fmt.Sprintf("error in builtin %s in frame %d at ip %d: %s",
+		e.Builtin, e.FramesIndex, e.Ip, e.Message)
+}
+
+func (vm *VM) newBuiltinError(builtin object.Object, errorValue *object.Error) *BuiltinError {
+	name, ok := vm.builtins.NameOf(builtin)
+	if !ok {
+		name = "<anonymous>"
+	}
+
+	frame := vm.currentFrame()
+
+	return &BuiltinError{
+		Builtin: name,
+		Message: errorValue.Message,
+		// the ip is at the operand of the OpCall instruction
+		FramesIndex: vm.framesIndex - 1,
+		Ip:          frame.ip - 1,
+	}
+}
+
+// InstructionLimitError reports that the VM executed more instructions
+// than its limits allow.
+type InstructionLimitError struct {
+	Limit int
+}
+
+func (e *InstructionLimitError) Error() string {
+	return fmt.Sprintf("instruction limit exceeded: %d", e.Limit)
+}
+
+// ThrownError carries a value raised by throw that no try caught.
+type ThrownError struct {
+	Value object.Object
+}
+
+func (e *ThrownError) Error() string {
+	return fmt.Sprintf("uncaught exception: %s", e.Value.Inspect())
+}
+
+// TaskError reports the error a spawned task failed with, which aborts
+// the whole program.
+type TaskError struct {
+	Task int
+	Err  error
+}
+
+func (e *TaskError) Error() string {
+	return fmt.Sprintf("task %d: %s", e.Task, e.Err)
+}
+
+func (e *TaskError) Unwrap() error { return e.Err }
+
+// caughtValue is what a catch receives for err: the value given to throw,
+// or an error object describing any other runtime error.
+func caughtValue(err error) object.Object {
+	var thrown *ThrownError
+	if errors.As(err, &thrown) {
+		return thrown.Value
+	}
+
+	return &object.Error{Message: err.Error()}
+}
@@ -0,0 +1,116 @@
+package vm
+
+import (
+	"fmt"
+	compilerObject "github.com/carmooo/monkey_compiler/object"
+	"github.com/carmooo/monkey_interpreter/object"
+)
+
+// newGenerator replaces a call to a generator function and its arguments
+// on the stack with the generator the call creates.
+func (vm *VM) newGenerator(cl *compilerObject.Closure, numArgs int) error {
+	args := vm.stack[vm.sp-numArgs : vm.sp]
+	gen := compilerObject.NewGenerator(cl, args)
+
+	vm.sp = vm.sp - numArgs - 1
+
+	return vm.push(gen)
+}
+
+// resumeGenerator pushes the frame of a suspended generator, with its
+// locals and operands restored on top of the stack, so that it runs like a
+// regular call until it yields or returns. Resuming a finished generator
+// evaluates to Null.
+func (vm *VM) resumeGenerator(gen *compilerObject.Generator, numArgs int) error {
+	if numArgs > 1 {
+		return fmt.Errorf("wrong number of arguments: want=0 or 1, got=%d", numArgs)
+	}
+
+	var value object.Object = Null
+	if numArgs == 1 {
+		value = vm.stack[vm.sp-1]
+	}
+
+	switch gen.State {
+	case compilerObject.GeneratorRunning:
+		return fmt.Errorf("generator is already running")
+	case compilerObject.GeneratorDone:
+		vm.sp = vm.sp - numArgs - 1
+		return vm.push(Null)
+	}
+
+	if vm.framesIndex >= len(vm.frames) {
+		return fmt.Errorf("frame overflow")
+	}
+
+	basePointer := vm.sp - numArgs
+	if basePointer+len(gen.Stack) >= len(vm.stack) {
+		return fmt.Errorf("stack overflow")
+	}
+
+	copy(vm.stack[basePointer:], gen.Stack)
+	vm.sp = basePointer + len(gen.Stack)
+
+	for _, suspended := range gen.Upvalues {
+		stackIndex := basePointer + suspended.Offset
+		suspended.Upvalue.Reopen(&vm.stack[stackIndex])
+		vm.openUpvalues = append(vm.openUpvalues, openUpvalue{
+			stackIndex: stackIndex,
+			upvalue:    suspended.Upvalue,
+		})
+	}
+
+	frame := NewFrame(gen.Closure, basePointer)
+	frame.ip = gen.Ip
+	frame.generator = gen
+	vm.pushFrame(frame)
+
+	started := gen.Started()
+	gen.State = compilerObject.GeneratorRunning
+	gen.Stack = nil
+	gen.Upvalues = nil
+
+	// the value resumed with is the result of the pending yield
+	if started {
+		return vm.push(value)
+	}
+	return nil
+}
+
+// suspendGenerator saves the state of the generator running in the current
+// frame and pops the frame, closing the upvalues that point into it.
+func (vm *VM) suspendGenerator() *Frame {
+	frame := vm.popFrame()
+	gen := frame.generator
+
+	gen.Stack = make([]object.Object, vm.sp-frame.basePointer)
+	copy(gen.Stack, vm.stack[frame.basePointer:vm.sp])
+	gen.Ip = frame.ip
+
+	i := len(vm.openUpvalues)
+	for i > 0 && vm.openUpvalues[i-1].stackIndex >= frame.basePointer {
+		i--
+	}
+	for _, open := range vm.openUpvalues[i:] {
+		open.upvalue.Close()
+		gen.Upvalues = append(gen.Upvalues, compilerObject.SuspendedUpvalue{
+			Offset:  open.stackIndex - frame.basePointer,
+			Upvalue: open.upvalue,
+		})
+	}
+	vm.openUpvalues = vm.openUpvalues[:i]
+
+	gen.State = compilerObject.GeneratorSuspended
+
+	return frame
+}
+
+// abandonFrames finishes the generators running in the frames above
+// framesIndex, which an error is about to unwind.
+func (vm *VM) abandonFrames(framesIndex int) {
+	for i := vm.framesIndex - 1; i >= framesIndex; i-- {
+		if gen := vm.frames[i].generator; gen != nil {
+			gen.Finish()
+		}
+	}
+}
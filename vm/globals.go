@@ -0,0 +1,73 @@
+package vm
+
+import (
+	"fmt"
+	"github.com/carmooo/monkey_compiler/compiler"
+	"github.com/carmooo/monkey_interpreter/object"
+)
+
+// Globals gives hosts access to global variables by name. It maps names to
+// slots of a globals store through the symbol table the program was, or
+// is about to be, compiled with.
+type Globals struct {
+	symbolTable *compiler.SymbolTable
+	store       []object.Object
+}
+
+func NewGlobals(symbolTable *compiler.SymbolTable, store []object.Object) *Globals {
+	return &Globals{symbolTable: symbolTable, store: store}
+}
+
+// Globals returns a view of the globals of this VM, which must be running
+// bytecode compiled with symbolTable.
+func (vm *VM) Globals(symbolTable *compiler.SymbolTable) *Globals {
+	return NewGlobals(symbolTable, vm.globals)
+}
+
+// Get returns the value of the global called name. It returns false if
+// the global is not defined or has not been assigned yet.
+func (g *Globals) Get(name string) (object.Object, bool) {
+	sym, ok := g.resolve(name)
+	if !ok || g.store[sym.Index] == nil {
+		return nil, false
+	}
+	return g.store[sym.Index], true
+}
+
+// Set assigns value to the global called name, defining it first if
+// needed so that programs compiled afterwards can refer to it.
+func (g *Globals) Set(name string, value object.Object) error {
+	sym, ok := g.resolve(name)
+	if !ok {
+		if _, defined := g.symbolTable.Resolve(name); defined {
+			return fmt.Errorf("cannot set %s: not a global", name)
+		}
+		sym = g.symbolTable.Define(name)
+	}
+
+	if sym.Index >= len(g.store) {
+		return fmt.Errorf("cannot set %s: globals store is full", name)
+	}
+
+	g.store[sym.Index] = value
+	return nil
+}
+
+// Names returns the names of all defined globals in sorted order.
+func (g *Globals) Names() []string {
+	symbols := g.symbolTable.Globals()
+
+	names := make([]string, len(symbols))
+	for i, sym := range symbols {
+		names[i] = sym.Name
+	}
+	return names
+}
+
+func (g *Globals) resolve(name string) (compiler.Symbol, bool) {
+	sym, ok := g.symbolTable.Resolve(name)
+	if !ok || sym.Scope != compiler.GlobalScope {
+		return compiler.Symbol{}, false
+	}
+	return sym, true
+}
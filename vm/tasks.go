@@ -0,0 +1,484 @@
+package vm
+
+import (
+	"errors"
+	"fmt"
+	"github.com/carmooo/monkey_compiler/compiler"
+	compilerObject "github.com/carmooo/monkey_compiler/object"
+	"github.com/carmooo/monkey_interpreter/object"
+	"time"
+)
+
+const CHANNEL_OBJECT = "CHANNEL_OBJECT"
+
+const (
+	defaultTimeSlice        = 10 * time.Millisecond
+	defaultInstructionSlice = 1000
+
+	// how many instructions run between checks of the time slice
+	timeSliceCheckInterval = 256
+)
+
+var errDeadlock = errors.New("deadlock: all tasks are blocked")
+
+// errTaskCancelled unwinds the tasks that are still blocked or runnable
+// when the program finishes or a task fails.
+var errTaskCancelled = errors.New("task cancelled")
+
+// Scheduling configures how a VM switches between the tasks started by
+// spawn.
+//
+// Tasks are cooperative: they run one at a time, each on its own stack and
+// frames, and only switch when the running task blocks on a channel or is
+// preempted between two instructions. All tasks share the globals store,
+// and each instruction is atomic with respect to the other tasks, but
+// anything longer, like `x += 1` on a global, can be interleaved with
+// other tasks unless they synchronize over channels.
+type Scheduling struct {
+	// TimeSlice is how long a task runs before it is preempted in favour
+	// of the other runnable tasks. Defaults to 10ms.
+	TimeSlice time.Duration
+
+	// Deterministic preempts tasks after a fixed number of instructions
+	// instead of a time slice, so a program interleaves its tasks the same
+	// way on every run. Meant for tests.
+	Deterministic bool
+	// InstructionSlice is the number of instructions a task runs before
+	// it is preempted in deterministic mode. Defaults to 1000.
+	InstructionSlice int
+}
+
+// SetScheduling configures the scheduling of tasks. It must be called
+// before Run.
+func (vm *VM) SetScheduling(scheduling Scheduling) {
+	vm.scheduling = scheduling
+}
+
+// Channel passes values between tasks. An unbuffered channel hands every
+// value from a sender directly to a receiver, while a buffered one holds up
+// to its capacity before senders block.
+type Channel struct {
+	capacity int
+	buffer   []object.Object
+	closed   bool
+
+	// the tasks blocked on the channel, in the order they blocked
+	senders   []*task
+	receivers []*task
+}
+
+func (c *Channel) Type() object.ObjectType { return CHANNEL_OBJECT }
+func (c *Channel) Inspect() string {
+	return fmt.Sprintf("Channel[%p]", c)
+}
+
+func (c *Channel) remove(t *task) {
+	c.senders = removeTask(c.senders, t)
+	c.receivers = removeTask(c.receivers, t)
+}
+
+// task is a function running concurrently with the main program, on a VM
+// of its own that shares the globals of the main one. Each task runs in a
+// goroutine, but only the one holding the scheduler's baton executes.
+type task struct {
+	id   int
+	vm   *VM
+	wake chan struct{}
+
+	// the channel the task is blocked on, if any
+	blockedOn *Channel
+	// the value a blocked sender offers, or that a blocked receiver got
+	value object.Object
+	// set when a blocked receiver was woken by close
+	done bool
+	// the error to fail the blocked operation with
+	err error
+}
+
+type scheduler struct {
+	scheduling Scheduling
+
+	main    *task
+	current *task
+	nextID  int
+
+	// the spawned tasks that haven't finished, in the order they started
+	live []*task
+	// the tasks waiting for the baton, in the order they will get it
+	runnable []*task
+
+	// set once the main program has finished
+	draining bool
+	// the first error a task failed with
+	failed *TaskError
+
+	// instructions and time since the current task got the baton
+	ticks      int
+	sliceStart time.Time
+}
+
+// tasks returns the scheduler of the VM, making the code it runs the main
+// task on the first use.
+func (vm *VM) tasks() *scheduler {
+	if vm.sched == nil {
+		main := &task{vm: vm, wake: make(chan struct{}, 1)}
+		vm.task = main
+		vm.sched = &scheduler{
+			scheduling: vm.scheduling,
+			main:       main,
+			current:    main,
+			sliceStart: time.Now(),
+		}
+	}
+	return vm.sched
+}
+
+// Spawn implements the spawn builtin. The task only starts once the
+// running one blocks, is preempted or, for the main program, finishes.
+// For a Call made outside of Run, the main program finishes when the
+// Call returns.
+func (vm *VM) Spawn(fn object.Object, args ...object.Object) (object.Object, error) {
+	switch fn.(type) {
+	case *compilerObject.Closure, *object.Builtin, *compilerObject.HostBuiltin:
+	default:
+		return &object.Error{Message: fmt.Sprintf("argument to `spawn` must be a function, got %s", fn.Type())}, nil
+	}
+
+	s := vm.tasks()
+	s.nextID++
+
+	t := &task{id: s.nextID, vm: vm.newTaskVM(), wake: make(chan struct{}, 1)}
+	t.vm.task = t
+
+	// the arguments are a slice of this task's stack
+	args = append([]object.Object(nil), args...)
+
+	s.live = append(s.live, t)
+	s.runnable = append(s.runnable, t)
+	go s.start(t, fn, args)
+
+	return Null, nil
+}
+
+// newTaskVM returns a VM with a stack and frames of its own that shares
+// everything else with vm.
+func (vm *VM) newTaskVM() *VM {
+	child := New(&compiler.ByteCode{Constants: vm.constants})
+	child.SetLimits(Limits{StackSize: len(vm.stack), MaxFrames: len(vm.frames)})
+
+	child.globals = vm.globals
+	child.builtins = vm.builtins
+	child.CheckedArithmetic = vm.CheckedArithmetic
+	child.RaiseBuiltinErrors = vm.RaiseBuiltinErrors
+	child.maxInstructions = vm.maxInstructions
+	child.executed = vm.executed
+	child.sched = vm.sched
+
+	return child
+}
+
+// NewChannel implements the channel builtin.
+func (vm *VM) NewChannel(capacity int) object.Object {
+	return &Channel{capacity: capacity}
+}
+
+// Send implements the send builtin.
+func (vm *VM) Send(channel, value object.Object) (object.Object, error) {
+	ch, ok := channel.(*Channel)
+	if !ok {
+		return &object.Error{Message: fmt.Sprintf("argument to `send` must be CHANNEL, got %s", channel.Type())}, nil
+	}
+	if ch.closed {
+		return nil, fmt.Errorf("send on closed channel")
+	}
+
+	s := vm.tasks()
+
+	if len(ch.receivers) > 0 {
+		receiver := ch.receivers[0]
+		ch.receivers = ch.receivers[1:]
+		receiver.value, receiver.done = value, false
+		s.ready(receiver)
+		return Null, nil
+	}
+
+	if len(ch.buffer) < ch.capacity {
+		ch.buffer = append(ch.buffer, value)
+		return Null, nil
+	}
+
+	vm.task.value = value
+	err := s.block(vm.task, ch, &ch.senders)
+	if err != nil {
+		return nil, err
+	}
+
+	return Null, nil
+}
+
+// Receive implements the receive builtin.
+func (vm *VM) Receive(channel object.Object) (object.Object, error) {
+	ch, ok := channel.(*Channel)
+	if !ok {
+		return &object.Error{Message: fmt.Sprintf("argument to `receive` must be CHANNEL, got %s", channel.Type())}, nil
+	}
+
+	s := vm.tasks()
+
+	if len(ch.buffer) > 0 {
+		value := ch.buffer[0]
+		ch.buffer = ch.buffer[1:]
+
+		// the first blocked sender fits in the buffer now
+		if len(ch.senders) > 0 {
+			sender := ch.senders[0]
+			ch.senders = ch.senders[1:]
+			ch.buffer = append(ch.buffer, sender.value)
+			sender.value = nil
+			s.ready(sender)
+		}
+
+		return compilerObject.IterationResult(value, false), nil
+	}
+
+	if len(ch.senders) > 0 {
+		sender := ch.senders[0]
+		ch.senders = ch.senders[1:]
+		value := sender.value
+		sender.value = nil
+		s.ready(sender)
+		return compilerObject.IterationResult(value, false), nil
+	}
+
+	if ch.closed {
+		return compilerObject.IterationResult(Null, true), nil
+	}
+
+	t := vm.task
+	err := s.block(t, ch, &ch.receivers)
+	if err != nil {
+		return nil, err
+	}
+
+	value, done := t.value, t.done
+	t.value, t.done = nil, false
+
+	return compilerObject.IterationResult(value, done), nil
+}
+
+// Close implements the close builtin.
+func (vm *VM) Close(channel object.Object) (object.Object, error) {
+	ch, ok := channel.(*Channel)
+	if !ok {
+		return &object.Error{Message: fmt.Sprintf("argument to `close` must be CHANNEL, got %s", channel.Type())}, nil
+	}
+	if ch.closed {
+		return nil, fmt.Errorf("close of closed channel")
+	}
+
+	s := vm.tasks()
+	ch.closed = true
+
+	for _, receiver := range ch.receivers {
+		receiver.value, receiver.done = Null, true
+		s.ready(receiver)
+	}
+	for _, sender := range ch.senders {
+		sender.err = fmt.Errorf("send on closed channel")
+		s.ready(sender)
+	}
+	ch.receivers, ch.senders = nil, nil
+
+	return Null, nil
+}
+
+// start runs in the goroutine of a spawned task.
+func (s *scheduler) start(t *task, fn object.Object, args []object.Object) {
+	<-t.wake
+
+	err := s.woken(t)
+	if err == nil {
+		_, err = t.vm.Call(fn, args...)
+	}
+
+	s.exit(t, err)
+}
+
+// exit passes the baton on for a task that finished. With nothing else to
+// run, the main program gets it back: it has either finished too or is
+// blocked for good.
+func (s *scheduler) exit(t *task, err error) {
+	s.live = removeTask(s.live, t)
+
+	if err != nil && !errors.Is(err, errTaskCancelled) && s.failed == nil {
+		s.failed = &TaskError{Task: t.id, Err: err}
+	}
+
+	next := s.dequeue()
+	if next == nil {
+		next = s.deadlock()
+	}
+
+	s.switchTo(next)
+}
+
+// deadlock returns the main program for it to take the baton back when no
+// other task can run. Unless it has finished, it is blocked for good, so
+// its blocked operation fails.
+func (s *scheduler) deadlock() *task {
+	main := s.main
+	if ch := main.blockedOn; ch != nil {
+		ch.remove(main)
+		main.blockedOn = nil
+		main.err = errDeadlock
+	}
+	return main
+}
+
+// tick is called before every instruction of the task holding the baton
+// and preempts it once its slice is used up.
+func (s *scheduler) tick(t *task) error {
+	if len(s.runnable) == 0 {
+		return nil
+	}
+
+	s.ticks++
+	if s.scheduling.Deterministic {
+		slice := s.scheduling.InstructionSlice
+		if slice <= 0 {
+			slice = defaultInstructionSlice
+		}
+		if s.ticks < slice {
+			return nil
+		}
+	} else {
+		slice := s.scheduling.TimeSlice
+		if slice <= 0 {
+			slice = defaultTimeSlice
+		}
+		if s.ticks%timeSliceCheckInterval != 0 || time.Since(s.sliceStart) < slice {
+			return nil
+		}
+	}
+
+	s.runnable = append(s.runnable, t)
+	return s.park(t)
+}
+
+// block parks t on one of the queues of ch until another task wakes it.
+// When every task is blocked the main program fails with a deadlock, or,
+// once it has finished, the blocked task is cancelled.
+func (s *scheduler) block(t *task, ch *Channel, queue *[]*task) error {
+	if len(s.runnable) == 0 {
+		switch {
+		case s.draining:
+			return errTaskCancelled
+		case t == s.main:
+			return errDeadlock
+		}
+	}
+
+	*queue = append(*queue, t)
+	t.blockedOn = ch
+
+	return s.park(t)
+}
+
+// park hands the baton to the next runnable task and waits to get it back.
+func (s *scheduler) park(t *task) error {
+	next := s.dequeue()
+	if next == nil {
+		next = s.deadlock()
+	}
+
+	s.switchTo(next)
+	<-t.wake
+
+	return s.woken(t)
+}
+
+// woken returns the error a task that got the baton back has to fail its
+// pending operation with.
+func (s *scheduler) woken(t *task) error {
+	err := t.err
+	t.err = nil
+
+	if s.failed != nil {
+		if t == s.main {
+			return s.failed
+		}
+		return errTaskCancelled
+	}
+
+	return err
+}
+
+func (s *scheduler) ready(t *task) {
+	t.blockedOn = nil
+	s.runnable = append(s.runnable, t)
+}
+
+func (s *scheduler) dequeue() *task {
+	if len(s.runnable) == 0 {
+		return nil
+	}
+
+	t := s.runnable[0]
+	s.runnable = s.runnable[1:]
+
+	return t
+}
+
+func (s *scheduler) switchTo(t *task) {
+	s.current = t
+	s.ticks = 0
+	s.sliceStart = time.Now()
+
+	t.wake <- struct{}{}
+}
+
+// wait is called by the main program once it has finished, with the error
+// it failed with. It runs the spawned tasks until they have all finished
+// or are blocked, and then cancels the ones left, so that no goroutine
+// outlives the Run or Call of the main program. It returns the error of
+// the program or else the first error a task failed with.
+func (s *scheduler) wait(err error) error {
+	main := s.main
+	s.draining = true
+
+	for err == nil && s.failed == nil && len(s.runnable) > 0 {
+		s.switchTo(s.dequeue())
+		<-main.wake
+	}
+
+	s.runnable = nil
+	for len(s.live) > 0 {
+		t := s.live[0]
+		if t.blockedOn != nil {
+			t.blockedOn.remove(t)
+			t.blockedOn = nil
+		}
+
+		t.err = errTaskCancelled
+		s.switchTo(t)
+		<-main.wake
+	}
+	s.current = main
+
+	if err != nil {
+		return err
+	}
+	if s.failed != nil {
+		return s.failed
+	}
+	return nil
+}
+
+func removeTask(tasks []*task, t *task) []*task {
+	for i, other := range tasks {
+		if other == t {
+			return append(tasks[:i], tasks[i+1:]...)
+		}
+	}
+	return tasks
+}
@@ -1,11 +1,15 @@
 package vm
 
 import (
+	"errors"
 	"fmt"
 	"github.com/carmooo/monkey_compiler/code"
 	"github.com/carmooo/monkey_compiler/compiler"
 	compilerObject "github.com/carmooo/monkey_compiler/object"
 	"github.com/carmooo/monkey_interpreter/object"
+	"math"
+	"math/big"
+	"strings"
 )
 
 const StackSize = 2048
@@ -17,11 +21,16 @@ var False = &object.Boolean{Value: false}
 
 var Null = &object.Null{}
 
+var defaultBuiltins = compilerObject.NewRegistry()
+
 type Frame struct {
 	cl *compilerObject.Closure
 	ip int
 
 	basePointer int
+
+	// the generator running in the frame, if any
+	generator *compilerObject.Generator
 }
 
 func NewFrame(cl *compilerObject.Closure, basePointer int) *Frame {
@@ -32,6 +41,23 @@ func (f *Frame) Instructions() code.Instructions {
 	return f.cl.Fn.Instructions
 }
 
+// handler returns the innermost handler of the frame's function covering
+// the instruction the frame is executing or, for a caller, the call it is
+// waiting on.
+func (f *Frame) handler() (compilerObject.Handler, bool) {
+	for _, h := range f.cl.Fn.Handlers {
+		if h.Start <= f.ip && f.ip < h.End {
+			return h, true
+		}
+	}
+	return compilerObject.Handler{}, false
+}
+
+type openUpvalue struct {
+	stackIndex int
+	upvalue    *compilerObject.Upvalue
+}
+
 type VM struct {
 	constants []object.Object
 
@@ -42,10 +68,52 @@ type VM struct {
 
 	frames      []*Frame
 	framesIndex int
+
+	// upvalues still pointing into the stack, ordered by stack index
+	openUpvalues []openUpvalue
+
+	// CheckedArithmetic makes integer +, - and * report int64 overflow
+	// as a runtime error instead of promoting the result to a BigInteger.
+	CheckedArithmetic bool
+
+	// RaiseBuiltinErrors turns an *object.Error returned by a builtin into
+	// a *BuiltinError that aborts the program. By default error values are
+	// ordinary results that scripts can inspect.
+	RaiseBuiltinErrors bool
+
+	builtins *compilerObject.Registry
+
+	maxInstructions int
+	// shared with the VMs of spawned tasks, which count against the same limit
+	executed *int
+
+	// the scheduler of spawned tasks, created by the first task builtin
+	sched      *scheduler
+	task       *task
+	scheduling Scheduling
+	// number of Run and Call invocations in progress, so only the
+	// outermost one waits for the spawned tasks
+	entered int
+
+	// result is the value of the last expression statement of the main
+	// program, or nil if the last statement produced none
+	result object.Object
+}
+
+// Limits bounds the resources a VM may use. Zero fields keep the defaults.
+type Limits struct {
+	StackSize int
+	MaxFrames int
+	// MaxInstructions makes Run fail once the VM has executed that many
+	// instructions. Zero means no limit.
+	MaxInstructions int
 }
 
 func New(bytecode *compiler.ByteCode) *VM {
-	mainFn := &compilerObject.CompiledFunction{Instructions: bytecode.Instructions}
+	mainFn := &compilerObject.CompiledFunction{
+		Instructions: bytecode.Instructions,
+		Handlers:     bytecode.Handlers,
+	}
 	mainClosure := &compilerObject.Closure{Fn: mainFn}
 	mainFrame := NewFrame(mainClosure, 0)
 
@@ -62,6 +130,10 @@ func New(bytecode *compiler.ByteCode) *VM {
 
 		frames:      frames,
 		framesIndex: 1,
+
+		builtins: defaultBuiltins,
+
+		executed: new(int),
 	}
 }
 
@@ -71,12 +143,211 @@ func NewWithGlobalsStore(bytecode *compiler.ByteCode, store []object.Object) *VM
 	return vm
 }
 
+// SetLimits resizes the stack and frames of the VM. It must be called
+// before Run.
+func (vm *VM) SetLimits(limits Limits) {
+	if limits.StackSize > 0 {
+		stack := make([]object.Object, limits.StackSize)
+		copy(stack, vm.stack[:vm.sp])
+		vm.stack = stack
+	}
+
+	if limits.MaxFrames > 0 {
+		frames := make([]*Frame, limits.MaxFrames)
+		copy(frames, vm.frames[:vm.framesIndex])
+		vm.frames = frames
+	}
+
+	vm.maxInstructions = limits.MaxInstructions
+}
+
+// SetBuiltins replaces the default builtins with the registry the
+// bytecode was compiled against.
+func (vm *VM) SetBuiltins(builtins *compilerObject.Registry) {
+	vm.builtins = builtins
+}
+
+// Run executes the bytecode and never panics: unexpected failures inside
+// the VM are recovered and returned as an *InternalError, leaving the
+// stack and frames as they were at the time of the failure.
+//
+// Once the main program has finished, Run keeps running the tasks it
+// spawned until they finish or block, cancels the blocked ones and reports
+// the first error a task failed with as a *TaskError.
 func (vm *VM) Run() error {
+	vm.entered++
+	err := vm.run(0)
+	vm.entered--
+
+	return vm.finishTasks(err)
+}
+
+// finishTasks waits for the tasks spawned by the main task once the
+// outermost Run or Call on it returns, so that no goroutine outlives it.
+func (vm *VM) finishTasks(err error) error {
+	if vm.entered > 0 || vm.sched == nil || vm.task != vm.sched.main {
+		return err
+	}
+
+	err = vm.sched.wait(err)
+	vm.sched, vm.task = nil, nil
+
+	return err
+}
+
+// RunProgram runs the bytecode like Run and returns the value of the
+// program's last statement. Programs that are empty or end with a let
+// statement evaluate to Null. A return statement at the top level ends the
+// program with its value.
+func (vm *VM) RunProgram() (object.Object, error) {
+	vm.result = nil
+
+	err := vm.Run()
+	if err != nil {
+		return nil, err
+	}
+
+	if vm.result == nil {
+		return Null, nil
+	}
+	return vm.result, nil
+}
+
+// Call calls a closure or builtin with args and returns its result. It is
+// re-entrant: host code can use it before or after Run, and builtins can
+// use it while Run is executing. The call runs on top of the current stack
+// and frames, which are left as they were once it returns. If the call
+// fails, only its own frames are abandoned.
+//
+// Like Run, a Call made from outside of Run keeps running the tasks the
+// function spawned until they finish or block before it returns.
+func (vm *VM) Call(fn object.Object, args ...object.Object) (object.Object, error) {
+	vm.entered++
+	result, err := vm.call(fn, args...)
+	vm.entered--
+
+	err = vm.finishTasks(err)
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func (vm *VM) call(fn object.Object, args ...object.Object) (result object.Object, err error) {
+	sp, framesIndex := vm.sp, vm.framesIndex
+
+	defer func() {
+		if r := recover(); r != nil {
+			err = vm.newInternalError(r, vm.currentFrame().ip, code.OpCall)
+		}
+		if err != nil {
+			vm.abandonFrames(framesIndex)
+			vm.closeUpvalues(sp)
+			vm.sp, vm.framesIndex = sp, framesIndex
+			result = nil
+		}
+	}()
+
+	err = vm.push(fn)
+	if err != nil {
+		return nil, err
+	}
+	for _, arg := range args {
+		err = vm.push(arg)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = vm.executeCall(len(args))
+	if err != nil {
+		return nil, err
+	}
+
+	if vm.framesIndex > framesIndex {
+		err = vm.run(framesIndex)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return vm.pop(), nil
+}
+
+// run executes instructions until the frames started above stopFrames
+// have returned or, for the main frame, until its instructions run out.
+// Errors raised inside a try of those frames are caught and execution
+// continues at the handler.
+func (vm *VM) run(stopFrames int) error {
+	for {
+		err := vm.execute(stopFrames)
+		if err == nil || !vm.catch(err, stopFrames) {
+			return err
+		}
+	}
+}
+
+// catch unwinds the stack and frames to the innermost handler covering the
+// ip of a frame above stopFrames and pushes the error for it. Failures of
+// the VM itself, exceeded limits and failed or cancelled tasks can't be
+// caught.
+func (vm *VM) catch(err error, stopFrames int) bool {
+	var internal *InternalError
+	var limit *InstructionLimitError
+	var failed *TaskError
+	if errors.As(err, &internal) || errors.As(err, &limit) ||
+		errors.As(err, &failed) || errors.Is(err, errTaskCancelled) {
+		return false
+	}
+
+	for i := vm.framesIndex - 1; i >= stopFrames; i-- {
+		frame := vm.frames[i]
+		h, ok := frame.handler()
+		if !ok {
+			continue
+		}
+
+		sp := frame.basePointer + frame.cl.Fn.NumLocals + h.Depth
+		vm.abandonFrames(i + 1)
+		vm.closeUpvalues(sp)
+		vm.sp, vm.framesIndex = sp, i+1
+		if vm.push(caughtValue(err)) != nil {
+			return false
+		}
+		frame.ip = h.Target - 1
+
+		return true
+	}
+
+	return false
+}
+
+func (vm *VM) execute(stopFrames int) (err error) {
 	var ip int
 	var instructions code.Instructions
 	var op code.Opcode
 
-	for vm.currentFrame().ip < len(vm.currentFrame().Instructions())-1 {
+	defer func() {
+		if r := recover(); r != nil {
+			err = vm.newInternalError(r, ip, op)
+		}
+	}()
+
+	for vm.framesIndex > stopFrames && vm.currentFrame().ip < len(vm.currentFrame().Instructions())-1 {
+		if vm.maxInstructions > 0 {
+			*vm.executed++
+			if *vm.executed > vm.maxInstructions {
+				return &InstructionLimitError{Limit: vm.maxInstructions}
+			}
+		}
+
+		if vm.sched != nil {
+			err := vm.sched.tick(vm.task)
+			if err != nil {
+				return err
+			}
+		}
+
 		vm.currentFrame().ip++
 
 		ip = vm.currentFrame().ip
@@ -93,14 +364,17 @@ func (vm *VM) Run() error {
 				return err
 			}
 
-		case code.OpAdd, code.OpSub, code.OpMul, code.OpDiv:
+		case code.OpAdd, code.OpSub, code.OpMul, code.OpDiv, code.OpMod:
 			err := vm.executeBinaryOperation(op)
 			if err != nil {
 				return err
 			}
 
 		case code.OpPop:
-			vm.pop()
+			popped := vm.pop()
+			if vm.framesIndex == 1 {
+				vm.result = popped
+			}
 
 		case code.OpTrue:
 			err := vm.push(True)
@@ -114,12 +388,18 @@ func (vm *VM) Run() error {
 				return err
 			}
 
-		case code.OpEqual, code.OpNotEqual, code.OpGreaterThan:
+		case code.OpEqual, code.OpNotEqual, code.OpGreaterThan, code.OpGreaterThanOrEqual:
 			err := vm.executeComparisonOperation(op)
 			if err != nil {
 				return err
 			}
 
+		case code.OpIn:
+			err := vm.executeInOperation()
+			if err != nil {
+				return err
+			}
+
 		case code.OpMinus:
 			err := vm.executeMinusOperation()
 			if err != nil {
@@ -141,12 +421,12 @@ func (vm *VM) Run() error {
 			vm.currentFrame().ip += 2
 
 			condition := vm.pop()
-			if !isTruthy(condition) {
+			if !compilerObject.IsTruthy(condition) {
 				vm.currentFrame().ip = pos - 1
 			}
 
 		case code.OpNull:
-			err := vm.push(&object.Null{})
+			err := vm.push(Null)
 			if err != nil {
 				return err
 			}
@@ -156,6 +436,10 @@ func (vm *VM) Run() error {
 			vm.currentFrame().ip += 2
 
 			vm.globals[globalIndex] = vm.pop()
+			if vm.framesIndex == 1 {
+				// a let statement ends the program without a value
+				vm.result = nil
+			}
 
 		case code.OpGetGlobal:
 			globalIndex := code.ReadUint16(instructions[ip+1:])
@@ -203,6 +487,29 @@ func (vm *VM) Run() error {
 				return err
 			}
 
+		case code.OpSetIndex:
+			value := vm.pop()
+			indexObject := vm.pop()
+			leftObject := vm.pop()
+
+			err := vm.executeSetIndex(leftObject, indexObject, value)
+			if err != nil {
+				return err
+			}
+
+		case code.OpDupPair:
+			left, right := vm.stack[vm.sp-2], vm.stack[vm.sp-1]
+
+			err := vm.push(left)
+			if err != nil {
+				return err
+			}
+
+			err = vm.push(right)
+			if err != nil {
+				return err
+			}
+
 		case code.OpCall:
 			numArgs := code.ReadUint8(instructions[ip+1:])
 			vm.currentFrame().ip++
@@ -215,17 +522,33 @@ func (vm *VM) Run() error {
 		case code.OpReturnValue:
 			returnValue := vm.pop()
 
+			if vm.framesIndex == 1 {
+				// a return at the top level ends the program with its value
+				vm.result = returnValue
+				vm.sp = 0
+				vm.currentFrame().ip = len(instructions) - 1
+				break
+			}
+
 			frame := vm.popFrame()
+			if frame.generator != nil {
+				frame.generator.Finish()
+			}
+			vm.closeUpvalues(frame.basePointer)
 			// the -1 avoids having to pop the just executed func
 			vm.sp = frame.basePointer - 1
 
 			err := vm.push(returnValue)
 			if err != nil {
-				return nil
+				return err
 			}
 
 		case code.OpReturn:
 			frame := vm.popFrame()
+			if frame.generator != nil {
+				frame.generator.Finish()
+			}
+			vm.closeUpvalues(frame.basePointer)
 			// the -1 avoids having to pop the just executed func
 			vm.sp = frame.basePointer - 1
 
@@ -255,7 +578,10 @@ func (vm *VM) Run() error {
 			builtinIndex := code.ReadUint8(instructions[ip+1:])
 			vm.currentFrame().ip++
 
-			definition := object.Builtins[builtinIndex]
+			definition, ok := vm.builtins.Get(int(builtinIndex))
+			if !ok {
+				return fmt.Errorf("undefined builtin: %d", builtinIndex)
+			}
 
 			err := vm.push(definition.Builtin)
 			if err != nil {
@@ -273,9 +599,9 @@ func (vm *VM) Run() error {
 				return fmt.Errorf("not a function: %+v", constant)
 			}
 
-			free := make([]object.Object, numFree)
+			free := make([]*compilerObject.Upvalue, numFree)
 			for i := 0; i < numFree; i++ {
-				free[i] = vm.stack[vm.sp-numFree+i]
+				free[i] = vm.stack[vm.sp-numFree+i].(*compilerObject.Upvalue)
 			}
 			vm.sp -= numFree
 
@@ -289,11 +615,85 @@ func (vm *VM) Run() error {
 			freeIndex := int(code.ReadUint8(instructions[ip+1:]))
 			vm.currentFrame().ip++
 
+			currentClosure := vm.currentFrame().cl
+			err := vm.push(currentClosure.FreeVariables[freeIndex].Get())
+			if err != nil {
+				return err
+			}
+
+		case code.OpSetFree:
+			freeIndex := int(code.ReadUint8(instructions[ip+1:]))
+			vm.currentFrame().ip++
+
+			currentClosure := vm.currentFrame().cl
+			currentClosure.FreeVariables[freeIndex].Set(vm.pop())
+
+		case code.OpImport:
+			constIndex := int(code.ReadUint16(instructions[ip+1:]))
+			slot := int(code.ReadUint16(instructions[ip+3:]))
+			vm.currentFrame().ip += 4
+
+			if exports := vm.globals[slot]; exports != nil {
+				err := vm.push(exports)
+				if err != nil {
+					return err
+				}
+				continue
+			}
+
+			constant := vm.constants[constIndex]
+			function, ok := constant.(*compilerObject.CompiledFunction)
+			if !ok {
+				return fmt.Errorf("not a function: %+v", constant)
+			}
+
+			err := vm.push(&compilerObject.Closure{Fn: function})
+			if err != nil {
+				return err
+			}
+
+			err = vm.executeCall(0)
+			if err != nil {
+				return err
+			}
+
+		case code.OpCaptureLocal:
+			localIndex := int(code.ReadUint8(instructions[ip+1:]))
+			vm.currentFrame().ip++
+
+			stackIndex := vm.currentFrame().basePointer + localIndex
+			err := vm.push(vm.captureUpvalue(stackIndex))
+			if err != nil {
+				return err
+			}
+
+		case code.OpCaptureFree:
+			freeIndex := int(code.ReadUint8(instructions[ip+1:]))
+			vm.currentFrame().ip++
+
 			currentClosure := vm.currentFrame().cl
 			err := vm.push(currentClosure.FreeVariables[freeIndex])
 			if err != nil {
 				return err
 			}
+
+		case code.OpThrow:
+			return &ThrownError{Value: vm.pop()}
+
+		case code.OpYield:
+			value := vm.pop()
+
+			if vm.currentFrame().generator == nil {
+				return fmt.Errorf("yield outside a generator")
+			}
+			frame := vm.suspendGenerator()
+			// the -1 avoids having to pop the resumed generator
+			vm.sp = frame.basePointer - 1
+
+			err := vm.push(value)
+			if err != nil {
+				return err
+			}
 		}
 	}
 	return nil
@@ -313,6 +713,38 @@ func (vm *VM) popFrame() *Frame {
 	return vm.frames[vm.framesIndex]
 }
 
+// captureUpvalue returns the open upvalue for a stack slot, creating it if
+// no closure has captured the slot yet so that all closures share it.
+func (vm *VM) captureUpvalue(stackIndex int) *compilerObject.Upvalue {
+	i := len(vm.openUpvalues)
+	for i > 0 && vm.openUpvalues[i-1].stackIndex >= stackIndex {
+		if vm.openUpvalues[i-1].stackIndex == stackIndex {
+			return vm.openUpvalues[i-1].upvalue
+		}
+		i--
+	}
+
+	upvalue := compilerObject.NewOpenUpvalue(&vm.stack[stackIndex])
+
+	vm.openUpvalues = append(vm.openUpvalues, openUpvalue{})
+	copy(vm.openUpvalues[i+1:], vm.openUpvalues[i:])
+	vm.openUpvalues[i] = openUpvalue{stackIndex: stackIndex, upvalue: upvalue}
+
+	return upvalue
+}
+
+// closeUpvalues closes every open upvalue at or above stackIndex, moving
+// the captured values off the stack before the slots are reused.
+func (vm *VM) closeUpvalues(stackIndex int) {
+	i := len(vm.openUpvalues)
+	for i > 0 && vm.openUpvalues[i-1].stackIndex >= stackIndex {
+		vm.openUpvalues[i-1].upvalue.Close()
+		vm.openUpvalues[i-1] = openUpvalue{}
+		i--
+	}
+	vm.openUpvalues = vm.openUpvalues[:i]
+}
+
 func (vm *VM) StackTop() object.Object {
 	if vm.sp == 0 {
 		return nil
@@ -320,12 +752,15 @@ func (vm *VM) StackTop() object.Object {
 	return vm.stack[vm.sp-1]
 }
 
+// LastPoppedStackElem returns whatever was last popped off the stack,
+// which is stale for programs that do not end with an expression. Use
+// RunProgram to get the result of a program.
 func (vm *VM) LastPoppedStackElem() object.Object {
 	return vm.stack[vm.sp]
 }
 
 func (vm *VM) push(o object.Object) error {
-	if vm.sp >= StackSize {
+	if vm.sp >= len(vm.stack) {
 		return fmt.Errorf("stack overflow")
 	}
 
@@ -336,6 +771,10 @@ func (vm *VM) push(o object.Object) error {
 }
 
 func (vm *VM) pop() object.Object {
+	if vm.sp == 0 {
+		panic("stack underflow")
+	}
+
 	o := vm.stack[vm.sp-1]
 	vm.sp--
 	return o
@@ -345,16 +784,29 @@ func (vm *VM) executeBinaryOperation(op code.Opcode) error {
 	right := vm.pop()
 	left := vm.pop()
 
+	if isSmallIntegerOperation(left, right) {
+		return vm.executeBinaryIntegerOperation(op, left, right)
+	}
+
 	leftType := left.Type()
 	rightType := right.Type()
 
 	switch {
 	case leftType == object.INTEGER_OBJECT && rightType == object.INTEGER_OBJECT:
-		return vm.executeBinaryIntegerOperation(op, left, right)
+		return vm.executeBinaryBigIntegerOperation(op, left, right)
 
 	case leftType == object.STRING_OBJECT && rightType == object.STRING_OBJECT:
 		return vm.executeBinaryStringOperation(op, left, right)
 
+	case isFloatOperation(left, right):
+		return vm.executeBinaryFloatOperation(op, left, right)
+
+	case op == code.OpMul && leftType == object.STRING_OBJECT && rightType == object.INTEGER_OBJECT:
+		return vm.executeStringRepetition(left, right)
+
+	case op == code.OpMul && leftType == object.INTEGER_OBJECT && rightType == object.STRING_OBJECT:
+		return vm.executeStringRepetition(right, left)
+
 	default:
 		return fmt.Errorf("unsupported types for binary operation: %s %s",
 			leftType, rightType)
@@ -366,23 +818,125 @@ func (vm *VM) executeBinaryIntegerOperation(op code.Opcode, left, right object.O
 	rightValue := right.(*object.Integer).Value
 
 	var result int64
+	var overflow bool
 
 	switch op {
 	case code.OpAdd:
 		result = leftValue + rightValue
+		overflow = (result > leftValue) != (rightValue > 0)
 	case code.OpSub:
 		result = leftValue - rightValue
+		overflow = (result < leftValue) != (rightValue > 0)
 	case code.OpMul:
 		result = leftValue * rightValue
+		overflow = leftValue != 0 &&
+			(result/leftValue != rightValue || (leftValue == -1 && rightValue == math.MinInt64))
 	case code.OpDiv:
+		if rightValue == 0 {
+			return fmt.Errorf("division by zero")
+		}
 		result = leftValue / rightValue
+		overflow = leftValue == math.MinInt64 && rightValue == -1
+	case code.OpMod:
+		if rightValue == 0 {
+			return fmt.Errorf("division by zero")
+		}
+		result = leftValue % rightValue
 	default:
 		return fmt.Errorf("unknown integer operator: %d", op)
 	}
 
+	if overflow {
+		if vm.CheckedArithmetic {
+			return fmt.Errorf("integer overflow: %d %s %d",
+				leftValue, integerOperatorSymbol(op), rightValue)
+		}
+		return vm.executeBinaryBigIntegerOperation(op, left, right)
+	}
+
 	return vm.push(&object.Integer{Value: result})
 }
 
+// executeBinaryBigIntegerOperation handles integers that do not fit into
+// an int64, either as operands or as the result. Division and modulo
+// truncate towards zero like their int64 counterparts.
+func (vm *VM) executeBinaryBigIntegerOperation(op code.Opcode, left, right object.Object) error {
+	leftValue, _ := compilerObject.ToBig(left)
+	rightValue, _ := compilerObject.ToBig(right)
+
+	result := new(big.Int)
+
+	switch op {
+	case code.OpAdd:
+		result.Add(leftValue, rightValue)
+	case code.OpSub:
+		result.Sub(leftValue, rightValue)
+	case code.OpMul:
+		result.Mul(leftValue, rightValue)
+	case code.OpDiv:
+		if rightValue.Sign() == 0 {
+			return fmt.Errorf("division by zero")
+		}
+		result.Quo(leftValue, rightValue)
+	case code.OpMod:
+		if rightValue.Sign() == 0 {
+			return fmt.Errorf("division by zero")
+		}
+		result.Rem(leftValue, rightValue)
+	default:
+		return fmt.Errorf("unknown integer operator: %d", op)
+	}
+
+	return vm.push(compilerObject.IntegerFromBig(result))
+}
+
+func (vm *VM) executeBinaryFloatOperation(op code.Opcode, left, right object.Object) error {
+	leftValue, _ := compilerObject.ToFloat(left)
+	rightValue, _ := compilerObject.ToFloat(right)
+
+	var result float64
+
+	switch op {
+	case code.OpAdd:
+		result = leftValue + rightValue
+	case code.OpSub:
+		result = leftValue - rightValue
+	case code.OpMul:
+		result = leftValue * rightValue
+	case code.OpDiv:
+		if rightValue == 0 {
+			return fmt.Errorf("division by zero")
+		}
+		result = leftValue / rightValue
+	case code.OpMod:
+		if rightValue == 0 {
+			return fmt.Errorf("division by zero")
+		}
+		result = math.Mod(leftValue, rightValue)
+	default:
+		return fmt.Errorf("unknown float operator: %d", op)
+	}
+
+	return vm.push(&compilerObject.Float{Value: result})
+}
+
+func integerOperatorSymbol(op code.Opcode) string {
+	switch op {
+	case code.OpAdd:
+		return "+"
+	case code.OpSub:
+		return "-"
+	case code.OpMul:
+		return "*"
+	case code.OpDiv:
+		return "/"
+	case code.OpMod:
+		return "%"
+	default:
+		return fmt.Sprintf("%d", op)
+	}
+}
+
 func (vm *VM) executeBinaryStringOperation(op code.Opcode, left, right object.Object) error {
 	leftValue := left.(*object.String).Value
 	rightValue := right.(*object.String).Value
@@ -393,12 +947,30 @@ func (vm *VM) executeBinaryStringOperation(op code.Opcode, left, right object.Ob
 	case code.OpAdd:
 		result = fmt.Sprintf("%s%s", leftValue, rightValue)
 	default:
-		return fmt.Errorf("unknown integer operator: %d", op)
+		return fmt.Errorf("unknown string operator: %d", op)
 	}
 
 	return vm.push(&object.String{Value: result})
 }
 
+func (vm *VM) executeStringRepetition(str, count object.Object) error {
+	value := str.(*object.String).Value
+	integer, ok := count.(*object.Integer)
+	if !ok {
+		return fmt.Errorf("string repetition too large: %s", count.Inspect())
+	}
+	n := integer.Value
+
+	if n < 0 {
+		return fmt.Errorf("negative string repetition count: %d", n)
+	}
+	if value != "" && n > int64(math.MaxInt32/len(value)) {
+		return fmt.Errorf("string repetition too large: %d", n)
+	}
+
+	return vm.push(&object.String{Value: strings.Repeat(value, int(n))})
+}
+
 func (vm *VM) executeComparisonOperation(op code.Opcode) error {
 	right := vm.pop()
 	left := vm.pop()
@@ -406,15 +978,27 @@ func (vm *VM) executeComparisonOperation(op code.Opcode) error {
 	leftType := left.Type()
 	rightType := right.Type()
 
-	if leftType == object.INTEGER_OBJECT && rightType == object.INTEGER_OBJECT {
+	if isSmallIntegerOperation(left, right) {
 		return vm.executeIntegerComparison(op, left, right)
 	}
 
+	if leftType == object.INTEGER_OBJECT && rightType == object.INTEGER_OBJECT {
+		return vm.executeBigIntegerComparison(op, left, right)
+	}
+
+	if leftType == object.STRING_OBJECT && rightType == object.STRING_OBJECT {
+		return vm.executeStringComparison(op, left, right)
+	}
+
+	if isFloatOperation(left, right) {
+		return vm.executeFloatComparison(op, left, right)
+	}
+
 	switch op {
 	case code.OpEqual:
-		return vm.push(nativeBoolToBoolean(left == right))
+		return vm.push(nativeBoolToBoolean(objectsEqual(left, right, nil)))
 	case code.OpNotEqual:
-		return vm.push(nativeBoolToBoolean(left != right))
+		return vm.push(nativeBoolToBoolean(!objectsEqual(left, right, nil)))
 	default:
 		return fmt.Errorf("unknown operator: %d", op)
 	}
@@ -431,28 +1015,111 @@ func (vm *VM) executeIntegerComparison(op code.Opcode, left, right object.Object
 		return vm.push(nativeBoolToBoolean(leftValue != rightValue))
 	case code.OpGreaterThan:
 		return vm.push(nativeBoolToBoolean(leftValue > rightValue))
+	case code.OpGreaterThanOrEqual:
+		return vm.push(nativeBoolToBoolean(leftValue >= rightValue))
 	default:
 		return fmt.Errorf("unknown operator: %d", op)
 	}
 }
 
+func (vm *VM) executeBigIntegerComparison(op code.Opcode, left, right object.Object) error {
+	leftValue, _ := compilerObject.ToBig(left)
+	rightValue, _ := compilerObject.ToBig(right)
+
+	cmp := leftValue.Cmp(rightValue)
+
+	switch op {
+	case code.OpEqual:
+		return vm.push(nativeBoolToBoolean(cmp == 0))
+	case code.OpNotEqual:
+		return vm.push(nativeBoolToBoolean(cmp != 0))
+	case code.OpGreaterThan:
+		return vm.push(nativeBoolToBoolean(cmp > 0))
+	case code.OpGreaterThanOrEqual:
+		return vm.push(nativeBoolToBoolean(cmp >= 0))
+	default:
+		return fmt.Errorf("unknown operator: %d", op)
+	}
+}
+
+func (vm *VM) executeFloatComparison(op code.Opcode, left, right object.Object) error {
+	leftValue, _ := compilerObject.ToFloat(left)
+	rightValue, _ := compilerObject.ToFloat(right)
+
+	switch op {
+	case code.OpEqual:
+		return vm.push(nativeBoolToBoolean(leftValue == rightValue))
+	case code.OpNotEqual:
+		return vm.push(nativeBoolToBoolean(leftValue != rightValue))
+	case code.OpGreaterThan:
+		return vm.push(nativeBoolToBoolean(leftValue > rightValue))
+	case code.OpGreaterThanOrEqual:
+		return vm.push(nativeBoolToBoolean(leftValue >= rightValue))
+	default:
+		return fmt.Errorf("unknown operator: %d", op)
+	}
+}
+
+func (vm *VM) executeStringComparison(op code.Opcode, left, right object.Object) error {
+	leftValue := left.(*object.String).Value
+	rightValue := right.(*object.String).Value
+
+	switch op {
+	case code.OpEqual:
+		return vm.push(nativeBoolToBoolean(leftValue == rightValue))
+	case code.OpNotEqual:
+		return vm.push(nativeBoolToBoolean(leftValue != rightValue))
+	case code.OpGreaterThan:
+		return vm.push(nativeBoolToBoolean(leftValue > rightValue))
+	case code.OpGreaterThanOrEqual:
+		return vm.push(nativeBoolToBoolean(leftValue >= rightValue))
+	default:
+		return fmt.Errorf("unknown operator: %d", op)
+	}
+}
+
+// executeInOperation tests whether the left operand is a substring of the
+// right one.
+func (vm *VM) executeInOperation() error {
+	right := vm.pop()
+	left := vm.pop()
+
+	if left.Type() != object.STRING_OBJECT || right.Type() != object.STRING_OBJECT {
+		return fmt.Errorf("unsupported types for in: %s %s",
+			left.Type(), right.Type())
+	}
+
+	leftValue := left.(*object.String).Value
+	rightValue := right.(*object.String).Value
+
+	return vm.push(nativeBoolToBoolean(strings.Contains(rightValue, leftValue)))
+}
+
 func (vm *VM) executeMinusOperation() error {
 	right := vm.pop()
-	if right.Type() != object.INTEGER_OBJECT {
+	switch right := right.(type) {
+	case *object.Integer:
+		if right.Value == math.MinInt64 {
+			if vm.CheckedArithmetic {
+				return fmt.Errorf("integer overflow: -(%d)", right.Value)
+			}
+			return vm.push(compilerObject.IntegerFromBig(new(big.Int).Neg(big.NewInt(right.Value))))
+		}
+		return vm.push(&object.Integer{Value: -right.Value})
+	case *compilerObject.BigInteger:
+		return vm.push(compilerObject.IntegerFromBig(new(big.Int).Neg(right.Value)))
+	case *compilerObject.Float:
+		return vm.push(&compilerObject.Float{Value: -right.Value})
+	default:
 		return fmt.Errorf("unsopported type for negation: %s", right.Type())
 	}
-	rightValue := right.(*object.Integer).Value
-	return vm.push(&object.Integer{Value: -rightValue})
 }
 
+// executeBangOperation negates the truthiness of the operand, which builtins
+// may have created as a fresh Boolean or Null instead of the singletons.
 func (vm *VM) executeBangOperation() error {
 	right := vm.pop()
-	switch right {
-	case False, Null:
-		return vm.push(True)
-	default:
-		return vm.push(False)
-	}
+	return vm.push(nativeBoolToBoolean(!compilerObject.IsTruthy(right)))
 }
 
 func (vm *VM) buildArray(startIndex, endIndex int) object.Object {
@@ -500,8 +1167,16 @@ func (vm *VM) executeIndexExpression(left, index object.Object) error {
 }
 
 func (vm *VM) executeArrayIndex(array, index object.Object) error {
-	arrayObject := array.(*object.Array)
-	i := index.(*object.Integer).Value
+	arrayObject, ok := array.(*object.Array)
+	if !ok {
+		return fmt.Errorf("index operator not supported: %T", array)
+	}
+	integer, ok := index.(*object.Integer)
+	if !ok {
+		// a BigInteger is always out of range
+		return vm.push(Null)
+	}
+	i := integer.Value
 	max := int64(len(arrayObject.Elements) - 1)
 
 	if 0 <= i && i <= max {
@@ -525,6 +1200,89 @@ func (vm *VM) executeHashIndex(hash, index object.Object) error {
 	return vm.push(pair.Value)
 }
 
+// executeSetIndex refuses to store a container inside itself, directly or
+// through nested containers. Inspect, puts and structural equality walk
+// values recursively, and a cyclic value would overflow the Go stack.
+func (vm *VM) executeSetIndex(left, index, value object.Object) error {
+	if reaches(value, left, nil) {
+		return fmt.Errorf("cannot store %s inside itself", left.Type())
+	}
+
+	switch left := left.(type) {
+	case *object.Array:
+		if index.Type() != object.INTEGER_OBJECT {
+			return fmt.Errorf("array index must be INTEGER, got %s", index.Type())
+		}
+		integer, ok := index.(*object.Integer)
+		if !ok {
+			return fmt.Errorf("index out of range: %s (length %d)",
+				index.Inspect(), len(left.Elements))
+		}
+
+		i := integer.Value
+		if i < 0 || i >= int64(len(left.Elements)) {
+			return fmt.Errorf("index out of range: %d (length %d)", i, len(left.Elements))
+		}
+
+		left.Elements[i] = value
+
+	case *object.Hash:
+		key, ok := index.(object.Hashable)
+		if !ok {
+			return fmt.Errorf("unusable as hash key: %s", index.Type())
+		}
+
+		left.Pairs[key.HashKey()] = object.HashPair{Key: index, Value: value}
+
+	default:
+		return fmt.Errorf("index assignment not supported: %s", left.Type())
+	}
+
+	return vm.push(value)
+}
+
+// reaches reports whether target is value or one of the arrays and hashes
+// nested in it.
+func reaches(value, target object.Object, visited map[object.Object]bool) bool {
+	if value == target {
+		return true
+	}
+
+	switch value := value.(type) {
+	case *object.Array:
+		if visited[value] {
+			return false
+		}
+		if visited == nil {
+			visited = make(map[object.Object]bool)
+		}
+		visited[value] = true
+
+		for _, el := range value.Elements {
+			if reaches(el, target, visited) {
+				return true
+			}
+		}
+
+	case *object.Hash:
+		if visited[value] {
+			return false
+		}
+		if visited == nil {
+			visited = make(map[object.Object]bool)
+		}
+		visited[value] = true
+
+		for _, pair := range value.Pairs {
+			if reaches(pair.Value, target, visited) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
 func (vm *VM) executeCall(numArgs int) error {
 	calee := vm.stack[vm.sp-1-numArgs]
 	switch calee := calee.(type) {
@@ -535,6 +1293,14 @@ func (vm *VM) executeCall(numArgs int) error {
 				calee.Fn.NumParameters, numArgs)
 		}
 
+		if calee.Fn.Generator {
+			return vm.newGenerator(calee, numArgs)
+		}
+
+		if vm.framesIndex >= len(vm.frames) {
+			return fmt.Errorf("frame overflow")
+		}
+
 		frame := NewFrame(calee, vm.sp-numArgs)
 		vm.pushFrame(frame)
 		// vm.sp += fn.numLocals
@@ -546,19 +1312,59 @@ func (vm *VM) executeCall(numArgs int) error {
 		args := vm.stack[vm.sp-numArgs : vm.sp]
 
 		result := calee.Fn(args...)
-		vm.sp -= numArgs + 1
 
-		if result != nil {
-			return vm.push(result)
-		} else {
-			return vm.push(Null)
+		return vm.returnFromBuiltin(calee, numArgs, result)
+
+	case *compilerObject.HostBuiltin:
+		args := vm.stack[vm.sp-numArgs : vm.sp]
+
+		result, err := calee.Fn(vm, args...)
+		if err != nil {
+			return err
 		}
 
+		return vm.returnFromBuiltin(calee, numArgs, result)
+
+	case *compilerObject.Generator:
+		return vm.resumeGenerator(calee, numArgs)
+
 	default:
 		return fmt.Errorf("calling non-function")
 	}
 }
 
+// returnFromBuiltin replaces the builtin and its arguments on the stack
+// with its result. With RaiseBuiltinErrors set, error values abort the
+// program instead.
+func (vm *VM) returnFromBuiltin(builtin object.Object, numArgs int, result object.Object) error {
+	if errorValue, ok := result.(*object.Error); ok && vm.RaiseBuiltinErrors {
+		return vm.newBuiltinError(builtin, errorValue)
+	}
+
+	vm.sp -= numArgs + 1
+
+	return vm.push(canonical(result))
+}
+
+// isSmallIntegerOperation is the fast path for two int64 operands.
+func isSmallIntegerOperation(left, right object.Object) bool {
+	_, leftOk := left.(*object.Integer)
+	_, rightOk := right.(*object.Integer)
+	return leftOk && rightOk
+}
+
+// isFloatOperation reports whether both operands are numbers and at least
+// one of them is a float, in which case integers are promoted to floats.
+func isFloatOperation(left, right object.Object) bool {
+	_, leftFloat := left.(*compilerObject.Float)
+	_, rightFloat := right.(*compilerObject.Float)
+	leftInteger := left.Type() == object.INTEGER_OBJECT
+	rightInteger := right.Type() == object.INTEGER_OBJECT
+
+	return (leftFloat || leftInteger) && (rightFloat || rightInteger) &&
+		(leftFloat || rightFloat)
+}
+
 func nativeBoolToBoolean(b bool) object.Object {
 	if b {
 		return True
@@ -566,13 +1372,111 @@ func nativeBoolToBoolean(b bool) object.Object {
 	return False
 }
 
-func isTruthy(o object.Object) bool {
+// canonical maps values produced outside the VM, such as builtin results,
+// onto the VM's Null, True and False singletons.
+func canonical(o object.Object) object.Object {
 	switch o := o.(type) {
+	case nil, *object.Null:
+		return Null
 	case *object.Boolean:
-		return o.Value
-	case *object.Null:
-		return false
+		return nativeBoolToBoolean(o.Value)
 	default:
+		return o
+	}
+}
+
+type objectPair struct {
+	left, right object.Object
+}
+
+// objectsEqual compares values structurally. Arrays and hashes are compared
+// element by element; pairs already being compared further up are assumed
+// equal so self-referencing collections terminate. Everything else, such as
+// closures and builtins, is compared by identity.
+func objectsEqual(left, right object.Object, comparing map[objectPair]bool) bool {
+	if left == right {
+		return true
+	}
+	if left == nil || right == nil {
+		return false
+	}
+	if isFloatOperation(left, right) {
+		leftValue, _ := compilerObject.ToFloat(left)
+		rightValue, _ := compilerObject.ToFloat(right)
+		return leftValue == rightValue
+	}
+	if left.Type() != right.Type() {
+		return false
+	}
+
+	switch left := left.(type) {
+	case *object.Integer:
+		right, ok := right.(*object.Integer)
+		return ok && left.Value == right.Value
+
+	case *compilerObject.BigInteger:
+		right, ok := right.(*compilerObject.BigInteger)
+		return ok && left.Value.Cmp(right.Value) == 0
+
+	case *object.Boolean:
+		right, ok := right.(*object.Boolean)
+		return ok && left.Value == right.Value
+
+	case *object.String:
+		right, ok := right.(*object.String)
+		return ok && left.Value == right.Value
+
+	case *object.Null:
+		return true
+
+	case *object.Array:
+		right, ok := right.(*object.Array)
+		if !ok || len(left.Elements) != len(right.Elements) {
+			return false
+		}
+
+		pair := objectPair{left, right}
+		if comparing[pair] {
+			return true
+		}
+		if comparing == nil {
+			comparing = make(map[objectPair]bool)
+		}
+		comparing[pair] = true
+		defer delete(comparing, pair)
+
+		for i, el := range left.Elements {
+			if !objectsEqual(el, right.Elements[i], comparing) {
+				return false
+			}
+		}
 		return true
+
+	case *object.Hash:
+		right, ok := right.(*object.Hash)
+		if !ok || len(left.Pairs) != len(right.Pairs) {
+			return false
+		}
+
+		pair := objectPair{left, right}
+		if comparing[pair] {
+			return true
+		}
+		if comparing == nil {
+			comparing = make(map[objectPair]bool)
+		}
+		comparing[pair] = true
+		defer delete(comparing, pair)
+
+		for key, leftPair := range left.Pairs {
+			rightPair, ok := right.Pairs[key]
+			if !ok || !objectsEqual(leftPair.Value, rightPair.Value, comparing) {
+				return false
+			}
+		}
+		return true
+
+	default:
+		return false
 	}
 }
@@ -2,12 +2,18 @@ package vm
 
 import (
 	"fmt"
+	"github.com/carmooo/monkey_compiler/ast"
+	"github.com/carmooo/monkey_compiler/code"
 	"github.com/carmooo/monkey_compiler/compiler"
-	"github.com/carmooo/monkey_interpreter/ast"
-	"github.com/carmooo/monkey_interpreter/lexer"
+	"github.com/carmooo/monkey_compiler/lexer"
+	compilerObject "github.com/carmooo/monkey_compiler/object"
+	"github.com/carmooo/monkey_compiler/parser"
 	"github.com/carmooo/monkey_interpreter/object"
-	"github.com/carmooo/monkey_interpreter/parser"
+	"math/big"
+	"reflect"
+	"runtime"
 	"testing"
+	"time"
 )
 
 func TestIntegerArithmetic(t *testing.T) {
@@ -29,6 +35,147 @@ func TestIntegerArithmetic(t *testing.T) {
 	runVmTests(t, tests)
 }
 
+func TestIntegerDivisionByZero(t *testing.T) {
+	tests := []vmTestCase{
+		{"1 / 0", "division by zero"},
+		{"let zero = 0; 10 / zero", "division by zero"},
+		{"fn(a) { a / (a - a) }(5)", "division by zero"},
+	}
+
+	runVmErrorTests(t, tests, func(vm *VM) {})
+}
+
+func TestCheckedIntegerArithmetic(t *testing.T) {
+	tests := []vmTestCase{
+		{"9223372036854775807 + 1", "integer overflow: 9223372036854775807 + 1"},
+		{"-9223372036854775807 - 2", "integer overflow: -9223372036854775807 - 2"},
+		{"4611686018427387904 * 2", "integer overflow: 4611686018427387904 * 2"},
+		{"(-9223372036854775807 - 1) / -1", "integer overflow: -9223372036854775808 / -1"},
+		{"-(-9223372036854775807 - 1)", "integer overflow: -(-9223372036854775808)"},
+		{"let min = -9223372036854775807 - 1; -min", "integer overflow: -(-9223372036854775808)"},
+	}
+
+	runVmErrorTests(t, tests, func(vm *VM) { vm.CheckedArithmetic = true })
+
+	unchecked := []vmTestCase{
+		{"9223372036854775806 + 1", 9223372036854775807},
+		{"-9223372036854775807 - 1", -9223372036854775808},
+		{"3037000499 * 3037000499", 9223372030926249001},
+		{"-(-9223372036854775807)", 9223372036854775807},
+	}
+
+	runVmTests(t, unchecked)
+}
+
+func TestBigIntegerPromotion(t *testing.T) {
+	tests := []vmTestCase{
+		{"9223372036854775807 + 1", bigInt("9223372036854775808")},
+		{"-9223372036854775807 - 2", bigInt("-9223372036854775809")},
+		{"4611686018427387904 * 4", bigInt("18446744073709551616")},
+		{"(-9223372036854775807 - 1) / -1", bigInt("9223372036854775808")},
+		{"-(-9223372036854775807 - 1)", bigInt("9223372036854775808")},
+		{"9223372036854775807 + 1 - 1", 9223372036854775807},
+		{"-(9223372036854775807 + 1)", -9223372036854775808},
+		{"(9223372036854775807 + 1) * (9223372036854775807 + 1)",
+			bigInt("85070591730234615865843651857942052864")},
+		{"(9223372036854775807 + 10) / 10", 922337203685477581},
+		{"9223372036854775807 * 3 % 10", 1},
+		{`int("100000000000000000000")`, bigInt("100000000000000000000")},
+		{"9223372036854775807 + 1 > 9223372036854775807", true},
+		{"9223372036854775807 + 1 == 9223372036854775807 + 1", true},
+		{"9223372036854775807 + 1 != 9223372036854775807", true},
+		{"-9223372036854775807 - 2 < 0", true},
+		{"[9223372036854775807 + 1] == [9223372036854775807 + 1]", true},
+		{"{9223372036854775807 + 1: 1}[9223372036854775807 + 1]", 1},
+		{"{9223372036854775807 + 1: 1}[1]", Null},
+		{"[1, 2][9223372036854775807 + 1]", Null},
+		{"float(9223372036854775807 + 1) == float(9223372036854775807)", true},
+		{"(9223372036854775807 + 1) * float(2) > 0", true},
+		{"99999999999999999999", bigInt("99999999999999999999")},
+		{"-99999999999999999999", bigInt("-99999999999999999999")},
+		{"9223372036854775808", bigInt("9223372036854775808")},
+		{"-9223372036854775808", -9223372036854775808},
+		{"99999999999999999999 - 99999999999999999998", 1},
+		{"99999999999999999999 == 9223372036854775807 * 10 + 7766279631452241929", true},
+		{"let x = 100000000000000000000; x / 100", 1000000000000000000},
+		{"{99999999999999999999: 1}[99999999999999999998 + 1]", 1},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestFloatArithmetic(t *testing.T) {
+	tests := []vmTestCase{
+		{"2.5", 2.5},
+		{"0.1 + 0.2", 0.30000000000000004},
+		{"1.5 * 2", 3.0},
+		{"-0.5 + 1", 0.5},
+		{"7.5 % 2", 1.5},
+		{"1.0 == 1", true},
+		{"float(1)", 1.0},
+		{`float("2.5")`, 2.5},
+		{"float(5) / 2", 2.5},
+		{"5 / float(2)", 2.5},
+		{"float(1) + 2", 3.0},
+		{"2 - float(1) / 4", 1.75},
+		{"float(3) * float(3)", 9.0},
+		{"float(7) % 2", 1.0},
+		{"-float(1) / 2", -0.5},
+		{"(float(1) + 2) * 3 / 4", 2.25},
+		{"float(1) == 1", true},
+		{"1 == float(1)", true},
+		{"float(1) != 1", false},
+		{"float(3) / 2 > 1", true},
+		{"float(3) / 2 < 1", false},
+		{"float(3) / 2 >= float(6) / 4", true},
+		{"[1, 2] == [float(1), 2]", true},
+		{"{float(5) / 2: 1}[float(5) / 2]", 1},
+		{"{2.5: 1}[float(5) / 2]", 1},
+		{`{1: "a"}[1.0]`, "a"},
+		{`{1.0: "a"}[1]`, "a"},
+		{`{0: "zero"}[-0.0]`, "zero"},
+		{`{-0.0: "zero"}[0.0]`, "zero"},
+		{`{-3: "a"}[-3.0]`, "a"},
+		{`{9223372036854775807 + 1: "big"}[float(9223372036854775807 + 1)]`, "big"},
+		{`{float("1e30"): "big"}[int(float("1e30"))]`, "big"},
+		{`{1.5: "a"}[1]`, Null},
+	}
+
+	runVmTests(t, tests)
+
+	errorTests := []vmTestCase{
+		{"float(1) / 0", "division by zero"},
+		{`float(1) + "a"`, "unsupported types for binary operation: FLOAT STRING"},
+	}
+
+	runVmErrorTests(t, errorTests, func(vm *VM) {})
+}
+
+func TestNumericConversionBuiltins(t *testing.T) {
+	tests := []vmTestCase{
+		{"int(5)", 5},
+		{"int(float(7) / 2)", 3},
+		{"int(-float(7) / 2)", -3},
+		{`int("42")`, 42},
+		{`int("x")`, &object.Error{Message: `could not parse "x" as integer`}},
+		{`int([])`, &object.Error{Message: "argument to `int` not supported, got ARRAY"}},
+		{`float("x")`, &object.Error{Message: `could not parse "x" as float`}},
+		{"float(1, 2)", &object.Error{Message: "wrong number of arguments. got=2, want=1"}},
+		{"round(float(5) / 2)", 3},
+		{"round(-float(5) / 2)", -3},
+		{"round(float(9) / 4)", 2},
+		{"round(4)", 4},
+		{"floor(float(7) / 2)", 3},
+		{"floor(-float(7) / 2)", -4},
+		{"floor(4)", 4},
+		{`floor("4")`, &object.Error{Message: "argument to `floor` not supported, got STRING"}},
+		{`int(float("1e30"))`, bigInt("1000000000000000019884624838656")},
+		{`int(float("1e300") * float("1e300"))`, &object.Error{Message: "argument to `int` out of integer range, got +Inf"}},
+	}
+
+	runVmTests(t, tests)
+}
+
 func TestBooleanExpressions(t *testing.T) {
 	tests := []vmTestCase{
 		{"true", true},
@@ -65,6 +212,140 @@ func TestBooleanExpressions(t *testing.T) {
 	runVmTests(t, tests)
 }
 
+func TestAdditionalOperators(t *testing.T) {
+	tests := []vmTestCase{
+		{"5 % 2", 1},
+		{"-5 % 2", -1},
+		{"10 * 3 % 7", 2},
+		{"1 <= 2", true},
+		{"2 <= 2", true},
+		{"3 <= 2", false},
+		{"1 >= 2", false},
+		{"2 >= 2", true},
+		{"3 >= 2", true},
+		{"true && true", true},
+		{"true && false", false},
+		{"false && true", false},
+		{"1 && 2", true},
+		{"1 > 2 && len(1)", false},
+		{"true || false", true},
+		{"false || true", true},
+		{"false || false", false},
+		{"if (false) { 1 } || 0", true},
+		{"1 < 2 || len(1)", true},
+		{`"a" <= "b"`, true},
+		{`"a" <= "a"`, true},
+		{`"b" <= "a"`, false},
+		{`"a" >= "b"`, false},
+		{`"b" >= "b"`, true},
+		{`"key" in "monkey"`, true},
+		{`"mon" + "k" in "monkey"`, true},
+		{`"" in "monkey"`, true},
+		{`"donkey" in "monkey"`, false},
+	}
+
+	runVmTests(t, tests)
+
+	errorTests := []vmTestCase{
+		{"1 % 0", "division by zero"},
+	}
+
+	runVmErrorTests(t, errorTests, func(vm *VM) {})
+}
+
+func TestStructuralEquality(t *testing.T) {
+	tests := []vmTestCase{
+		{"[1, 2] == [1, 2]", true},
+		{"[1, 2] != [1, 2]", false},
+		{"[1, 2] == [2, 1]", false},
+		{"[1, 2] == [1, 2, 3]", false},
+		{"[[1], [2]] == [[1], [2]]", true},
+		{"[[1], [2]] == [[1], [3]]", false},
+		{`[1, "a", true] == [1, "a", true]`, true},
+		{`[1, "a", true] == [1, "b", true]`, false},
+		{"[] == []", true},
+		{"[1] == 1", false},
+		{`{1: 2, "a": [3]} == {"a": [3], 1: 2}`, true},
+		{`{1: 2} == {1: 3}`, false},
+		{`{1: 2} == {2: 2}`, false},
+		{`{1: 2} == {1: 2, 2: 3}`, false},
+		{"{} == {}", true},
+		{"{} == []", false},
+		{"if (false) { 1 } == if (false) { 2 }", true},
+		{"if (false) { 1 } != if (false) { 2 }", false},
+		{"if (false) { 1 } == false", false},
+		{"puts() == if (false) { 1 }", true},
+		{"first([]) == last([])", true},
+		{"let f = fn() { 1 }; f == f", true},
+		{"fn() { 1 } == fn() { 1 }", false},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestNullSingleton(t *testing.T) {
+	tests := []vmTestCase{
+		{"if (false) { 1 }", Null},
+		{"fn() { }()", Null},
+		{"puts()", Null},
+		{"first([])", Null},
+		{"[1][5]", Null},
+		{"{}[1]", Null},
+		{"!if (false) { 1 }", true},
+		{"!puts()", true},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestCyclicEquality(t *testing.T) {
+	left := &object.Array{}
+	left.Elements = []object.Object{&object.Integer{Value: 1}, left}
+	right := &object.Array{}
+	right.Elements = []object.Object{&object.Integer{Value: 1}, right}
+
+	if !objectsEqual(left, right, nil) {
+		t.Errorf("self-referencing arrays with equal elements are not equal")
+	}
+
+	other := &object.Array{}
+	other.Elements = []object.Object{&object.Integer{Value: 2}, other}
+
+	if objectsEqual(left, other, nil) {
+		t.Errorf("self-referencing arrays with different elements are equal")
+	}
+}
+
+// Host code can store arrays with unset elements, which compare unequal to
+// anything but themselves.
+func TestEqualityWithNilElements(t *testing.T) {
+	symbolTable := compiler.NewSymbolTable()
+	symbolTable.DefineBuiltins(compilerObject.NewRegistry())
+	store := make([]object.Object, GlobalsSize)
+
+	err := NewGlobals(symbolTable, store).Set("arr", &object.Array{Elements: []object.Object{nil}})
+	if err != nil {
+		t.Fatalf("set error: %s", err)
+	}
+
+	comp := compiler.NewWithState([]object.Object{}, symbolTable)
+	err = comp.Compile(parse("[arr == [1], [1] == arr, arr == arr]"))
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	vm := NewWithGlobalsStore(comp.ByteCode(), store)
+	err = vm.Run()
+	if err != nil {
+		t.Fatalf("vm error: %s", err)
+	}
+
+	result := vm.LastPoppedStackElem().(*object.Array)
+	for i, expected := range []bool{false, false, true} {
+		testExpectedObject(t, expected, result.Elements[i])
+	}
+}
+
 func TestConditionals(t *testing.T) {
 	tests := []vmTestCase{
 		{"if (true) { 10 }", 10},
@@ -82,11 +363,136 @@ func TestConditionals(t *testing.T) {
 	runVmTests(t, tests)
 }
 
+func TestLoops(t *testing.T) {
+	tests := []vmTestCase{
+		{"let i = 0; while (i < 5) { let i = i + 1 }; i", 5},
+		{"while (false) { 1 }", Null},
+		{"let x = for (;;) { break }; x", Null},
+		{"let i = 0; while (true) { if (i == 3) { break }; let i = i + 1 }; i", 3},
+		{"let i = 0; while (true) { let x = if (i > 1) { break } else { i }; let i = i + 1 }; i", 2},
+		{`
+		let sum = 0;
+		for (let i = 0; i < 10; let i = i + 1) {
+			if (i % 2 == 0) { continue }
+			let sum = sum + i
+		}
+		sum
+		`, 25},
+		{`
+		let n = 0;
+		for (let i = 0; i < 3; let i = i + 1) {
+			for (let j = 0; true; let j = j + 1) {
+				if (j == i) { break }
+				let n = n + 1
+			}
+		}
+		n
+		`, 3},
+		{`
+		let find = fn(xs) {
+			let i = 0;
+			while (i < len(xs)) {
+				if (xs[i] > 2) { return i }
+				let i = i + 1
+			};
+			-1
+		};
+		[find([1, 2, 3, 4]), find([1])]
+		`, []int{2, -1}},
+		{`
+		let collatz = fn(n) {
+			let steps = 0;
+			while (n != 1) {
+				let steps = steps + 1;
+				if (n % 2 == 0) { let n = n / 2; continue }
+				let n = 3 * n + 1
+			}
+			steps
+		};
+		collatz(27)
+		`, 111},
+		{"let i = 0; while (i < 100000) { let i = i + 1 }; i", 100000},
+	}
+
+	runVmTests(t, tests)
+}
+
 func TestGlobalLetStatements(t *testing.T) {
 	tests := []vmTestCase{
 		{"let one = 1; one", 1},
 		{"let one = 1; let two = 2; one + two", 3},
 		{"let one = 1; let two = one + one; one + two", 3},
+		{"let one_two = 12; let _ = 1; one_two + _", 13},
+	}
+
+	runVmTests(t, tests)
+}
+
+// A let of a name that is already bound in the same scope reuses its slot,
+// so closures that captured the old binding see the new value.
+func TestRedefinition(t *testing.T) {
+	tests := []vmTestCase{
+		{"let x = 1; let x = x + 1; x", 2},
+		{"let x = 1; let f = fn() { x }; let x = 2; f()", 2},
+		{"fn() { let x = 1; let f = fn() { x }; let x = 2; f() }()", 2},
+		{"fn(x) { let x = x * 2; x }(3)", 6},
+		{"let x = 1; let f = fn() { let x = 5; x }; [f(), x]", []int{5, 1}},
+	}
+
+	runVmTests(t, tests)
+}
+
+// Every REPL line is compiled with the symbol table and run against the
+// globals store of the previous lines.
+func TestRedefinitionAcrossCompilations(t *testing.T) {
+	symbolTable := compiler.NewSymbolTable()
+	symbolTable.DefineBuiltins(compilerObject.NewRegistry())
+	constants := []object.Object{}
+	store := make([]object.Object, GlobalsSize)
+
+	lines := []string{"let x = 1;", "let f = fn() { x };", "let x = 2;", "f()"}
+	for _, line := range lines {
+		comp := compiler.NewWithState(constants, symbolTable)
+		err := comp.Compile(parse(line))
+		if err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+
+		byteCode := comp.ByteCode()
+		constants = byteCode.Constants
+
+		vm := NewWithGlobalsStore(byteCode, store)
+		err = vm.Run()
+		if err != nil {
+			t.Fatalf("vm error: %s", err)
+		}
+
+		if line == "f()" {
+			testExpectedObject(t, 2, vm.LastPoppedStackElem())
+		}
+	}
+
+	symbol, ok := symbolTable.Resolve("x")
+	if !ok || symbol.Index != 0 {
+		t.Errorf("x is not in the first global slot. got=%+v", symbol)
+	}
+}
+
+func TestAssignments(t *testing.T) {
+	tests := []vmTestCase{
+		{`let a = 1; a = 2; a`, 2},
+		{`let a = 1; a = 2`, 2},
+		{`let a = 1; a += 2; a`, 3},
+		{`let a = 10; a -= 2; a`, 8},
+		{`let a = 10; a *= 2; a`, 20},
+		{`let a = 10; a /= 2; a`, 5},
+		{`let a = 1; let b = 2; a = b = 3; a + b`, 6},
+		{`fn() { let a = 1; a += 1; a }()`, 2},
+		{`let a = 1; fn() { a = 5 }(); a`, 5},
+		{`fn(a) { a *= a; a }(4)`, 16},
+		{`fn(a) { fn() { a = 2; a }() }(1)`, 2},
+		{`let a = 1; let a = 2; a`, 2},
+		{`let a = 0; for (let i = 0; i < 4; i += 1) { a += i }; a`, 6},
 	}
 
 	runVmTests(t, tests)
@@ -97,11 +503,42 @@ func TestStringExpressions(t *testing.T) {
 		{`"monkey"`, "monkey"},
 		{`"mon" + "key"`, "monkey"},
 		{`"mon" + "key" + "banana"`, "monkeybanana"},
+		{`"ab" * 3`, "ababab"},
+		{`2 * "ab"`, "abab"},
+		{`"ab" * 0`, ""},
+		{`"" * 5`, ""},
 	}
 
 	runVmTests(t, tests)
 }
 
+func TestStringComparison(t *testing.T) {
+	tests := []vmTestCase{
+		{`"a" == "a"`, true},
+		{`"a" == "b"`, false},
+		{`"a" != "a"`, false},
+		{`"a" != "b"`, true},
+		{`"mon" + "key" == "monkey"`, true},
+		{`let s = "monkey"; s == "monkey"`, true},
+		{`"a" < "b"`, true},
+		{`"b" < "a"`, false},
+		{`"abc" > "abd"`, false},
+		{`"abd" > "abc"`, true},
+		{`"ab" < "abc"`, true},
+		{`"" < "a"`, true},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestNegativeStringRepetition(t *testing.T) {
+	tests := []vmTestCase{
+		{`"ab" * -1`, "negative string repetition count: -1"},
+	}
+
+	runVmErrorTests(t, tests, func(vm *VM) {})
+}
+
 func TestArrayExpressions(t *testing.T) {
 	tests := []vmTestCase{
 		{"[]", []int{}},
@@ -145,6 +582,50 @@ func TestIndexExpression(t *testing.T) {
 	runVmTests(t, tests)
 }
 
+func TestIndexAssignment(t *testing.T) {
+	tests := []vmTestCase{
+		{`let a = [1, 2, 3]; a[0] = 5; a`, []int{5, 2, 3}},
+		{`let a = [1, 2, 3]; a[2] = 5`, 5},
+		{`let a = [[1], [2]]; a[1][0] = 7; a[1]`, []int{7}},
+		{`let a = [1, 2]; let b = a; b[1] = 9; a`, []int{1, 9}},
+		{`let h = {}; h["k"] = 1; h["k"]`, 1},
+		{`let h = {"k": 1}; h["k"] = h["k"] + 1; h["k"]`, 2},
+		{`let h = {1: 1}; h[true] = 2; h`, map[object.HashKey]int64{
+			(&object.Integer{Value: 1}).HashKey():    1,
+			(&object.Boolean{Value: true}).HashKey(): 2,
+		}},
+		{`let set = fn(a, i) { a[i] = i * i }; let a = [0, 0, 0]; set(a, 2); a`, []int{0, 0, 4}},
+		{`let a = [0, 0]; let b = [1]; a[0] = b; a[1] = b; a[1][0]`, 1},
+		{`let a = [1]; let h = {}; h["a"] = a; h["b"] = [a]; h["b"][0][0]`, 1},
+		{`let a = [1, 2, 3]; a[1] += 5; a`, []int{1, 7, 3}},
+		{`let a = [1, 2, 3]; a[2] *= 4`, 12},
+		{`let h = {"k": 10}; h["k"] -= 3; h["k"] /= 7; h["k"]`, 1},
+		{`let h = {"k": "a"}; h["k"] += "b"; h["k"]`, "ab"},
+		{`let a = [[1], [2]]; a[1][0] += 5; a[1]`, []int{7}},
+		{`let a = [0, 0]; for (let i = 0; i < 2; i += 1) { a[i] += i + 1 }; a`, []int{1, 2}},
+		{`let n = 0; let next = fn() { n += 1; n - 1 }; let a = [10, 20]; a[next()] += 5; a[0] * 10 + n`, 151},
+		{`let calls = 0; let get = fn(a) { calls += 1; a }; let a = [1]; get(a)[0] *= 4; a[0] * 10 + calls`, 41},
+		{`let a = [1, 2]; a[1] += try { throw 1 } catch (e) { e + 1 }; a`, []int{1, 4}},
+	}
+
+	runVmTests(t, tests)
+
+	errorTests := []vmTestCase{
+		{`let a = [1, 2]; a[2] = 1`, "index out of range: 2 (length 2)"},
+		{`let a = [1, 2]; a[-1] = 1`, "index out of range: -1 (length 2)"},
+		{`let a = [1, 2]; a["x"] = 1`, "array index must be INTEGER, got STRING"},
+		{`let h = {}; h[[1]] = 1`, "unusable as hash key: ARRAY"},
+		{`let s = "abc"; s[0] = 1`, "index assignment not supported: STRING"},
+		{`let a = [1]; a[0] = a`, "cannot store ARRAY inside itself"},
+		{`let h = {}; h["self"] = h`, "cannot store HASH inside itself"},
+		{`let a = [0]; let b = [[a]]; a[0] = b`, "cannot store ARRAY inside itself"},
+		{`let h = {}; let a = [{"h": h}]; h[1] = a`, "cannot store HASH inside itself"},
+		{`let a = [1]; a[1] += 1`, "unsupported types for binary operation: NULL INTEGER"},
+	}
+
+	runVmErrorTests(t, errorTests, func(vm *VM) {})
+}
+
 func TestCallingFunctionsWithoutArguments(t *testing.T) {
 	tests := []vmTestCase{
 		{
@@ -538,6 +1019,209 @@ func TestClosures(t *testing.T) {
 	runVmTests(t, tests)
 }
 
+func TestMutableCapturedVariables(t *testing.T) {
+	tests := []vmTestCase{
+		{
+			input: `
+					let newCounter = fn() {
+						let count = 0;
+						fn() { count += 1 };
+					};
+					let counter = newCounter();
+					counter();
+					counter();
+					counter();
+			`,
+			expected: 3,
+		},
+		{
+			input: `
+					let newCounter = fn() {
+						let count = 0;
+						fn() { count += 1 };
+					};
+					let one = newCounter();
+					let two = newCounter();
+					one();
+					one();
+					two();
+			`,
+			expected: 1,
+		},
+		{
+			input: `
+					fn() {
+						let count = 0;
+						let increment = fn() { count += 1 };
+						increment();
+						increment();
+						count;
+					}();
+			`,
+			expected: 2,
+		},
+		{
+			input: `
+					let newPair = fn() {
+						let value = 0;
+						[fn() { value += 10 }, fn() { value }];
+					};
+					let pair = newPair();
+					pair[0]();
+					pair[0]();
+					pair[1]();
+			`,
+			expected: 20,
+		},
+		{
+			input: `
+					let outer = fn() {
+						let value = 1;
+						let middle = fn() {
+							fn() { value *= 5 };
+						};
+						middle()();
+						value;
+					};
+					outer();
+			`,
+			expected: 5,
+		},
+		{
+			input: `
+					fn() {
+						let value = 1;
+						let get = fn() { value };
+						let value = 2;
+						get();
+					}();
+			`,
+			expected: 2,
+		},
+		{
+			input: `
+					fn() {
+						let countDown = fn(x) {
+							if (x == 0) { return 0; }
+							countDown(x - 1);
+						};
+						countDown(3);
+					}();
+			`,
+			expected: 0,
+		},
+	}
+
+	runVmTests(t, tests)
+}
+
+type mapImporter map[string]string
+
+func (mi mapImporter) Resolve(from, path string) (string, error) {
+	return path, nil
+}
+
+func (mi mapImporter) Read(path string) (string, error) {
+	source, ok := mi[path]
+	if !ok {
+		return "", fmt.Errorf("module not found")
+	}
+	return source, nil
+}
+
+func TestImports(t *testing.T) {
+	importer := mapImporter{
+		"math": `
+			let square = fn(x) { x * x };
+			let SumOfSquares = fn(a, b) { square(a) + square(b) };
+			let x = 1;
+			let X = x;
+			let GetX = fn() { x };
+		`,
+		"strings": `
+			let math = import "math";
+			let Shout = fn(s) { s + "!" };
+			let Twice = fn(a) { math["SumOfSquares"](a, a) };
+		`,
+		"state": `let Values = [0];`,
+	}
+
+	tests := []vmTestCase{
+		{`let math = import "math"; math["SumOfSquares"](2, 3)`, 13},
+		{`import "math"["square"]`, Null},
+		{`import "math"["x"]`, Null},
+		{`let x = 2; let math = import "math"; math["GetX"]() + x`, 3},
+		{`import "math"["X"]`, 1},
+		{`import "strings"["Twice"](3)`, 18},
+		{`import "strings"["Shout"]("hi")`, "hi!"},
+		{`let f = fn() { import "math"["X"] }; f() + f()`, 2},
+		{`
+			let state = import "state";
+			state["Values"][0] = 5;
+			import "state"["Values"][0];
+		`, 5},
+		{`
+			let read = fn() { import "state"["Values"] };
+			import "state"["Values"][0] = 7;
+			read()[0];
+		`, 7},
+	}
+
+	for _, tt := range tests {
+		comp := compiler.New()
+		comp.SetImporter(importer)
+
+		err := comp.Compile(parse(tt.input))
+		if err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+
+		vm := New(comp.ByteCode())
+		err = vm.Run()
+		if err != nil {
+			t.Fatalf("vm error: %s", err)
+		}
+
+		testExpectedObject(t, tt.expected, vm.LastPoppedStackElem())
+	}
+}
+
+func TestImportsAcrossCompilations(t *testing.T) {
+	importer := mapImporter{"counter": `let Count = [0];`}
+
+	symbolTable := compiler.NewSymbolTable()
+	symbolTable.DefineBuiltins(compilerObject.NewRegistry())
+	constants := []object.Object{}
+	store := make([]object.Object, GlobalsSize)
+
+	lines := []string{
+		`import "counter"["Count"][0] = 1;`,
+		`import "counter"["Count"][0] = import "counter"["Count"][0] + 1;`,
+		`import "counter"["Count"][0]`,
+	}
+	for _, line := range lines {
+		comp := compiler.NewWithState(constants, symbolTable)
+		comp.SetImporter(importer)
+		err := comp.Compile(parse(line))
+		if err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+
+		byteCode := comp.ByteCode()
+		constants = byteCode.Constants
+
+		vm := NewWithGlobalsStore(byteCode, store)
+		err = vm.Run()
+		if err != nil {
+			t.Fatalf("vm error: %s", err)
+		}
+
+		if line == lines[len(lines)-1] {
+			testExpectedObject(t, 2, vm.LastPoppedStackElem())
+		}
+	}
+}
+
 func TestRecursiveFibonacci(t *testing.T) {
 	tests := []vmTestCase{
 		{
@@ -561,46 +1245,1024 @@ func TestRecursiveFibonacci(t *testing.T) {
 	runVmTests(t, tests)
 }
 
-type vmTestCase struct {
-	input    string
-	expected interface{}
+func TestRecursionFrameOverflow(t *testing.T) {
+	tests := []vmTestCase{
+		{"let f = fn() { f() }; f();", "frame overflow"},
+	}
+
+	runVmErrorTests(t, tests, func(vm *VM) {})
 }
 
-func runVmTests(t *testing.T, tests []vmTestCase) {
-	t.Helper()
+func TestLimits(t *testing.T) {
+	runVmErrorTests(t, []vmTestCase{
+		{"let f = fn(n) { f(n + 1) }; f(0);", "frame overflow"},
+	}, func(vm *VM) { vm.SetLimits(Limits{MaxFrames: 10}) })
 
-	for _, tt := range tests {
-		program := parse(tt.input)
+	runVmErrorTests(t, []vmTestCase{
+		{"[1, 2, 3, 4, 5]", "stack overflow"},
+	}, func(vm *VM) { vm.SetLimits(Limits{StackSize: 4}) })
 
-		comp := compiler.New()
-		err := comp.Compile(program)
+	runVmErrorTests(t, []vmTestCase{
+		{"1; 2; 3;", "instruction limit exceeded: 5"},
+		{"let f = fn() { f() }; f();", "instruction limit exceeded: 5"},
+	}, func(vm *VM) { vm.SetLimits(Limits{MaxInstructions: 5}) })
+
+	runVmTests(t, []vmTestCase{
+		{"1; 2; 3", 3},
+	})
+}
+
+func TestHostBuiltins(t *testing.T) {
+	builtins := compilerObject.NewRegistry()
+	builtins.Register("add", 2, func(args ...object.Object) object.Object {
+		return &object.Integer{
+			Value: args[0].(*object.Integer).Value + args[1].(*object.Integer).Value,
+		}
+	})
+	builtins.Register("count", compilerObject.Variadic, func(args ...object.Object) object.Object {
+		return &object.Integer{Value: int64(len(args))}
+	})
+	builtins.Register("len", 1, func(args ...object.Object) object.Object {
+		return &object.String{Value: "replaced"}
+	})
+
+	tests := []vmTestCase{
+		{`add(1, 2)`, 3},
+		{`add(1)`, &object.Error{Message: "wrong number of arguments. got=1, want=2"}},
+		{`count()`, 0},
+		{`count(1, 2, 3)`, 3},
+		{`len([])`, "replaced"},
+		{`first([1, 2])`, 1},
+	}
+
+	for _, tt := range tests {
+		comp := compiler.NewWithBuiltins(builtins)
+		err := comp.Compile(parse(tt.input))
 		if err != nil {
 			t.Fatalf("compiler error: %s", err)
 		}
 
 		vm := New(comp.ByteCode())
+		vm.SetBuiltins(builtins)
+
 		err = vm.Run()
 		if err != nil {
 			t.Fatalf("vm error: %s", err)
 		}
 
-		stackElem := vm.LastPoppedStackElem()
+		testExpectedObject(t, tt.expected, vm.LastPoppedStackElem())
+	}
 
-		testExpectedObject(t, tt.expected, stackElem)
+	// bytecode referring to a builtin removed after compilation
+	only := compilerObject.NewEmptyRegistry()
+	only.Register("count", compilerObject.Variadic, func(args ...object.Object) object.Object {
+		return Null
+	})
+
+	comp := compiler.NewWithBuiltins(only)
+	err := comp.Compile(parse(`count(1)`))
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
 	}
-}
 
-func testExpectedObject(t *testing.T, expected interface{}, actual object.Object) {
-	t.Helper()
-	switch expected := expected.(type) {
+	removed := only.Clone()
+	removed.Remove("count")
 
-	case int:
-		err := testIntegerObject(int64(expected), actual)
-		if err != nil {
-			t.Errorf("testIntegerObject failed: %s", err)
-		}
+	vm := New(comp.ByteCode())
+	vm.SetBuiltins(removed)
 
-	case bool:
+	err = vm.Run()
+	if err == nil || err.Error() != "undefined builtin: 0" {
+		t.Errorf("wrong VM error. got=%v", err)
+	}
+}
+
+func TestCall(t *testing.T) {
+	comp := compiler.New()
+	err := comp.Compile(parse(`
+		let add = fn(a, b) { a + b };
+		let counter = fn() { let count = 0; fn() { count += 1 } };
+		let fail = fn() { 1 / 0 };
+		[add, counter(), fail, len]
+	`))
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	vm := New(comp.ByteCode())
+	err = vm.Run()
+	if err != nil {
+		t.Fatalf("vm error: %s", err)
+	}
+
+	fns := vm.LastPoppedStackElem().(*object.Array).Elements
+	add, count, fail, length := fns[0], fns[1], fns[2], fns[3]
+
+	result, err := vm.Call(add, &object.Integer{Value: 1}, &object.Integer{Value: 2})
+	if err != nil {
+		t.Fatalf("call error: %s", err)
+	}
+	testExpectedObject(t, 3, result)
+
+	for i := 1; i <= 3; i++ {
+		result, err = vm.Call(count)
+		if err != nil {
+			t.Fatalf("call error: %s", err)
+		}
+		testExpectedObject(t, i, result)
+	}
+
+	result, err = vm.Call(length, &object.String{Value: "four"})
+	if err != nil {
+		t.Fatalf("call error: %s", err)
+	}
+	testExpectedObject(t, 4, result)
+
+	sp, framesIndex := vm.sp, vm.framesIndex
+
+	_, err = vm.Call(fail)
+	if err == nil || err.Error() != "division by zero" {
+		t.Errorf("wrong call error. got=%v", err)
+	}
+	_, err = vm.Call(add, &object.Integer{Value: 1})
+	if err == nil || err.Error() != "wrong number of arguments: want=2, got=1" {
+		t.Errorf("wrong call error. got=%v", err)
+	}
+	_, err = vm.Call(&object.Integer{Value: 1})
+	if err == nil || err.Error() != "calling non-function" {
+		t.Errorf("wrong call error. got=%v", err)
+	}
+
+	if vm.sp != sp || vm.framesIndex != framesIndex {
+		t.Errorf("failed calls left the VM changed. sp=%d (was %d), framesIndex=%d (was %d)",
+			vm.sp, sp, vm.framesIndex, framesIndex)
+	}
+}
+
+func TestCallFromBuiltins(t *testing.T) {
+	builtins := compilerObject.NewRegistry()
+	builtins.RegisterHost("apply", compilerObject.Variadic,
+		func(caller compilerObject.Caller, args ...object.Object) (object.Object, error) {
+			return caller.Call(args[0], args[1:]...)
+		})
+	builtins.RegisterHost("twice", 2,
+		func(caller compilerObject.Caller, args ...object.Object) (object.Object, error) {
+			once, err := caller.Call(args[0], args[1])
+			if err != nil {
+				return nil, err
+			}
+			return caller.Call(args[0], once)
+		})
+
+	tests := []vmTestCase{
+		{`apply(fn(x) { x * 2 }, 21)`, 42},
+		{`apply(fn(a, b) { a - b }, 5, 3) + 1`, 3},
+		{`apply(len, [1, 2])`, 2},
+		{`twice(fn(x) { x + x }, 3)`, 12},
+		{`apply(fn(x) { twice(fn(y) { y * x }, x) }, 3)`, 27},
+		{`let x = 10; let f = fn(n) { n + x }; [apply(f, 1), f(2)]`, []int{11, 12}},
+		{`
+			let counter = fn() {
+				let count = 0;
+				let increment = fn() { count += 1 };
+				twice(fn(ignored) { increment() }, 0);
+				count
+			};
+			counter()
+		`, 2},
+		{`twice(fn(x) { x })`, &object.Error{Message: "wrong number of arguments. got=1, want=2"}},
+	}
+
+	for _, tt := range tests {
+		comp := compiler.NewWithBuiltins(builtins)
+		err := comp.Compile(parse(tt.input))
+		if err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+
+		vm := New(comp.ByteCode())
+		vm.SetBuiltins(builtins)
+
+		err = vm.Run()
+		if err != nil {
+			t.Fatalf("vm error: %s", err)
+		}
+
+		testExpectedObject(t, tt.expected, vm.LastPoppedStackElem())
+	}
+
+	errorTests := []vmTestCase{
+		{`apply(fn(x) { x / 0 }, 1)`, "division by zero"},
+		{`apply(fn(x) { x }, 1, 2)`, "wrong number of arguments: want=1, got=2"},
+		{`let f = fn(x) { apply(f, x) }; f(1)`, "stack overflow"},
+	}
+
+	for _, tt := range errorTests {
+		comp := compiler.NewWithBuiltins(builtins)
+		err := comp.Compile(parse(tt.input))
+		if err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+
+		vm := New(comp.ByteCode())
+		vm.SetBuiltins(builtins)
+
+		err = vm.Run()
+		if err == nil || err.Error() != tt.expected {
+			t.Errorf("wrong VM error. want=%q, got=%v", tt.expected, err)
+		}
+	}
+}
+
+func TestHigherOrderBuiltins(t *testing.T) {
+	tests := []vmTestCase{
+		{`map([1, 2, 3], fn(x) { x * 2 })`, []int{2, 4, 6}},
+		{`map([], fn(x) { x * 2 })`, []int{}},
+		{`map(["a", "bc"], len)`, []int{1, 2}},
+		{`let offset = 10; map([1, 2], fn(x) { x + offset })`, []int{11, 12}},
+		{`map([[1], [2, 3]], fn(a) { map(a, fn(x) { x * x }) })[1]`, []int{4, 9}},
+		{"filter([1, 2, 3, 4], fn(x) { x % 2 == 0 })", []int{2, 4}},
+		{`filter([1, 2], fn(x) { if (false) { 1 } })`, []int{}},
+		{`reduce([1, 2, 3, 4], 0, fn(acc, x) { acc + x })`, 10},
+		{`reduce([], 5, fn(acc, x) { acc + x })`, 5},
+		{`reduce(["a", "b"], "", fn(acc, x) { x + acc })`, "ba"},
+		{`each([1, 2], fn(x) { x })`, Null},
+		{`
+			let total = 0;
+			each([1, 2, 3], fn(x) { total += x });
+			total
+		`, 6},
+		{`any([1, 2, 3], fn(x) { x > 2 })`, true},
+		{`any([1, 2, 3], fn(x) { x > 3 })`, false},
+		{`any([], fn(x) { true })`, false},
+		{`all([1, 2, 3], fn(x) { x > 0 })`, true},
+		{`all([1, 2, 3], fn(x) { x > 1 })`, false},
+		{`all([], fn(x) { false })`, true},
+		{`find([1, 2, 3, 4], fn(x) { x > 2 })`, 3},
+		{`find([1, 2], fn(x) { x > 2 })`, Null},
+		{`sort_by([3, 1, 2], fn(x) { x })`, []int{1, 2, 3}},
+		{`sort_by([3, 1, 2], fn(x) { -x })`, []int{3, 2, 1}},
+		{`map(sort_by([[2, 1], [1, 2], [2, 3], [1, 4]], fn(p) { p[0] }), fn(p) { p[1] })`, []int{2, 4, 1, 3}},
+		{`reduce(sort_by(["bb", "a", "ccc"], fn(s) { s }), "", fn(acc, s) { acc + s })`, "abbccc"},
+		{"sort_by([3, 2, 1], fn(x) { float(x) / 2 + x % 2 })", []int{2, 1, 3}},
+		{`sort_by([2, 1], fn(x) { if (x == 1) { 9223372036854775807 + 1 } else { 1 } })`, []int{2, 1}},
+		{
+			`map(1, fn(x) { x })`,
+			&object.Error{Message: "argument to `map` must be ARRAY, got INTEGER"},
+		},
+		{
+			`filter([1], 1)`,
+			&object.Error{Message: "argument to `filter` must be a function, got INTEGER"},
+		},
+		{
+			`reduce([1], fn(acc, x) { acc })`,
+			&object.Error{Message: "wrong number of arguments. got=2, want=3"},
+		},
+		{
+			`find([1])`,
+			&object.Error{Message: "wrong number of arguments. got=1, want=2"},
+		},
+		{
+			`sort_by([1, 2], fn(x) { [x] })`,
+			&object.Error{Message: "keys of `sort_by` must be numbers or strings, got ARRAY"},
+		},
+		{
+			`sort_by([1, "a"], fn(x) { x })`,
+			&object.Error{Message: "keys of `sort_by` must all be numbers or all be strings, got INTEGER and STRING"},
+		},
+	}
+
+	runVmTests(t, tests)
+
+	errorTests := []vmTestCase{
+		{`map([1, 0], fn(x) { 1 / x })`, "division by zero"},
+		{`reduce([1], 0, fn(x) { x })`, "wrong number of arguments: want=1, got=2"},
+		{`sort_by([1, 2], fn(x) { x + "a" })`, "unsupported types for binary operation: INTEGER STRING"},
+	}
+
+	runVmErrorTests(t, errorTests, func(vm *VM) {})
+}
+
+func TestGlobals(t *testing.T) {
+	symbolTable := compiler.NewSymbolTable()
+	symbolTable.DefineBuiltins(compilerObject.NewRegistry())
+	store := make([]object.Object, GlobalsSize)
+
+	globals := NewGlobals(symbolTable, store)
+
+	err := globals.Set("config", &object.Hash{Pairs: map[object.HashKey]object.HashPair{}})
+	if err != nil {
+		t.Fatalf("set error: %s", err)
+	}
+	err = globals.Set("base", &object.Integer{Value: 40})
+	if err != nil {
+		t.Fatalf("set error: %s", err)
+	}
+
+	comp := compiler.NewWithState([]object.Object{}, symbolTable)
+	err = comp.Compile(parse(`
+		let result = base + 2;
+		base = 0;
+		config["key"] = "value";
+	`))
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	vm := NewWithGlobalsStore(comp.ByteCode(), store)
+	err = vm.Run()
+	if err != nil {
+		t.Fatalf("vm error: %s", err)
+	}
+
+	globals = vm.Globals(symbolTable)
+
+	result, ok := globals.Get("result")
+	if !ok {
+		t.Fatalf("result is not set")
+	}
+	testExpectedObject(t, 42, result)
+
+	base, _ := globals.Get("base")
+	testExpectedObject(t, 0, base)
+
+	config, _ := globals.Get("config")
+	if config.Inspect() != "{key: value}" {
+		t.Errorf("config was not updated. got=%s", config.Inspect())
+	}
+
+	if _, ok := globals.Get("missing"); ok {
+		t.Errorf("undefined global is readable")
+	}
+	if _, ok := globals.Get("len"); ok {
+		t.Errorf("builtin is readable as a global")
+	}
+
+	expectedNames := []string{"base", "config", "result"}
+	if names := globals.Names(); !reflect.DeepEqual(names, expectedNames) {
+		t.Errorf("wrong names. want=%v, got=%v", expectedNames, names)
+	}
+
+	err = globals.Set("len", &object.Integer{Value: 1})
+	if err == nil || err.Error() != "cannot set len: not a global" {
+		t.Errorf("wrong error. got=%v", err)
+	}
+
+	full := NewGlobals(compiler.NewSymbolTable(), make([]object.Object, 1))
+	full.Set("a", True)
+	err = full.Set("b", True)
+	if err == nil || err.Error() != "cannot set b: globals store is full" {
+		t.Errorf("wrong error. got=%v", err)
+	}
+}
+
+func TestRunProgram(t *testing.T) {
+	tests := []vmTestCase{
+		{``, Null},
+		{`1; 2`, 2},
+		{`let x = 5;`, Null},
+		{`let x = 5; x`, 5},
+		{`1; let x = 5;`, Null},
+		{"let x = 5; x = 6", 6},
+		{"let a = [1]; a[0] = 2", 2},
+		{`let f = fn() { 1; 2; 3 }; f(); let y = 1;`, Null},
+		{`let f = fn() { let z = 1; z }; 7; f()`, 1},
+		{`if (true) { let y = 1; }`, Null},
+		{`puts()`, Null},
+		{`return 5;`, 5},
+		{`1; return 5; 6`, 5},
+		{`let x = 1; return x; x = 2`, 1},
+		{`let x = 1; if (x > 0) { return x + 1 }; 9`, 2},
+		{`for (let i = 0; ; i += 1) { if (i == 3) { return [i, i * 2] } }`, []int{3, 6}},
+		{`let f = fn() { return 1; 2 }; return f() + 1; 7`, 2},
+	}
+
+	for _, tt := range tests {
+		comp := compiler.New()
+		err := comp.Compile(parse(tt.input))
+		if err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+
+		vm := New(comp.ByteCode())
+		result, err := vm.RunProgram()
+		if err != nil {
+			t.Fatalf("vm error: %s", err)
+		}
+
+		testExpectedObject(t, tt.expected, result)
+	}
+}
+
+func TestRaiseBuiltinErrors(t *testing.T) {
+	tests := []vmTestCase{
+		{"len(1) + 1", "error in builtin len in frame 0 at ip 5: argument to `len` not supported, got INTEGER"},
+		{"let f = fn() { first(1) }; f()", "error in builtin first in frame 1 at ip 5: argument to `first` must be ARRAY, got INTEGER"},
+		{"map([1], fn(x) { len(x) })", "error in builtin len in frame 1 at ip 4: argument to `len` not supported, got INTEGER"},
+		{"map(1, len)", "error in builtin map in frame 0 at ip 7: argument to `map` must be ARRAY, got INTEGER"},
+		{"push([], 1, 2)", "error in builtin push in frame 0 at ip 11: wrong number of arguments. got=3, want=2"},
+	}
+
+	runVmErrorTests(t, tests, func(vm *VM) { vm.RaiseBuiltinErrors = true })
+
+	comp := compiler.New()
+	err := comp.Compile(parse(`let x = len([1]); rest([]); x`))
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	vm := New(comp.ByteCode())
+	vm.RaiseBuiltinErrors = true
+	result, err := vm.RunProgram()
+	if err != nil {
+		t.Fatalf("vm error: %s", err)
+	}
+	testExpectedObject(t, 1, result)
+
+	comp = compiler.New()
+	err = comp.Compile(parse(`len(1)`))
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	vm = New(comp.ByteCode())
+	vm.RaiseBuiltinErrors = true
+	err = vm.Run()
+
+	builtinErr, ok := err.(*BuiltinError)
+	if !ok {
+		t.Fatalf("error is not *BuiltinError. got=%T (%v)", err, err)
+	}
+	if builtinErr.Builtin != "len" || builtinErr.FramesIndex != 0 || builtinErr.Ip != 5 {
+		t.Errorf("wrong builtin error. got=%+v", builtinErr)
+	}
+}
+
+func TestExceptions(t *testing.T) {
+	tests := []vmTestCase{
+		{`try { 1 } catch (e) { 2 }`, 1},
+		{`try { throw 1; 2 } catch (e) { e + 10 }`, 11},
+		{`try { throw "oops" } catch (e) { e }`, "oops"},
+		{`try { 1 / 0 } catch (e) { e }`, &object.Error{Message: "division by zero"}},
+		{`try { [1][0]() } catch (e) { e }`, &object.Error{Message: "calling non-function"}},
+		{`1 + try { 2 + throw 3 } catch (e) { e }`, 4},
+		// errors unwind the frames between the throw and the try
+		{`let f = fn(n) { if (n == 0) { throw "bottom" }; f(n - 1) }; try { f(10) } catch (e) { e }`, "bottom"},
+		{`fn(x) { let y = 2; try { throw x } catch (e) { e + y } }(1)`, 3},
+		// the operands below the try are kept and the ones above it dropped
+		{`[1, 2, try { 1 / 0 } catch (e) { 3 }]`, []int{1, 2, 3}},
+		{`fn(a) { let b = 2; [a, b, try { [4, 5, throw 3] } catch (e) { e }] }(1)`, []int{1, 2, 3}},
+		{`let f = fn() { [1, 2, 1 / 0] }; 10 + try { f() } catch (e) { 5 }`, 15},
+		{`let i = 0; try { while (true) { i += 1; if (i == 3) { throw i } } } catch (e) { e * 10 }`, 30},
+		// handlers nest and rethrow
+		{`try { try { throw 1 } catch (e) { throw e + 1 } } catch (e) { e + 1 }`, 3},
+		{`try { try { throw 1 } catch (e) { e } + throw 5 } catch (e) { e * 2 }`, 10},
+		// finally runs on every path and doesn't change the result
+		{"let n = 0; try { 1 } catch (e) { 2 } finally { n += 1 } + n", 2},
+		{"let n = 0; try { throw 1 } catch (e) { e + 1 } finally { n += 1 } + n", 3},
+		{"let n = 0; try { try { throw 1 } catch (e) { throw e } finally { n += 1 } } catch (e) { e + n }", 2},
+		// the catch only runs when something is thrown
+		{"let n = 0; try { 1 } catch (e) { n = 1 }; n", 0},
+		// errors raised inside callbacks of builtins are caught too
+		{`try { map([1, 2], fn(x) { throw x }) } catch (e) { e }`, 1},
+		{`map([1, 2], fn(x) { try { throw x } catch (e) { e * 10 } })`, []int{10, 20}},
+		// captured locals of unwound frames keep their values
+		{`let g = try { let a = 5; let h = fn() { a }; throw h } catch (e) { e }; g()`, 5},
+		// the catch binding is an ordinary binding of the scope
+		{`try { throw 1 } catch (err) { 0 }; err`, 1},
+		{`let e = 5; fn() { try { throw 1 } catch (e) { e } }() + e`, 6},
+		// a try without a catch runs finally and raises the error again
+		{"let n = 0; try { try { throw 1 } finally { n += 1 } } catch (e) { e * 10 + n }", 11},
+		{"let n = 0; try { 2 } finally { n += 1 } + n", 3},
+		// errors raised by finally replace the pending one
+		{`try { try { throw 1 } finally { throw 2 } } catch (e) { e }`, 2},
+		{`try { try { 1 } catch (e) { 0 } finally { throw 3 } } catch (e) { e }`, 3},
+	}
+
+	runVmTests(t, tests)
+
+	runVmErrorTests(t, []vmTestCase{
+		{`throw "oops"`, `uncaught exception: oops`},
+		{`throw [1, 2]`, `uncaught exception: [1, 2]`},
+		{`try { throw 1 } catch (e) { throw e + 1 }`, `uncaught exception: 2`},
+		{`try { throw 1 } catch (e) { throw e + 1 } finally { 3 }`, `uncaught exception: 2`},
+		{`map([1], fn(x) { throw x })`, `uncaught exception: 1`},
+	}, func(vm *VM) {})
+
+	// exceeded limits can't be caught
+	runVmErrorTests(t, []vmTestCase{
+		{`let f = fn() { f() }; try { f() } catch (e) { e }`, "instruction limit exceeded: 20"},
+	}, func(vm *VM) { vm.SetLimits(Limits{MaxInstructions: 20}) })
+
+	runVmTests(t, []vmTestCase{
+		{`let f = fn() { f() }; try { f() } catch (e) { e }`, &object.Error{Message: "frame overflow"}},
+	})
+
+	// builtin errors are caught as error objects when they are raised
+	runVmErrorTests(t, []vmTestCase{
+		{`let e = try { len(1) } catch (e) { e }; throw e`,
+			"uncaught exception: Error: error in builtin len in frame 0 at ip 5: argument to `len` not supported, got INTEGER"},
+	}, func(vm *VM) { vm.RaiseBuiltinErrors = true })
+}
+
+func TestJumpsAcrossTry(t *testing.T) {
+	tests := []vmTestCase{
+		// return leaves the try and runs finally on the way out
+		{`fn() { try { return 1 } catch (e) { 2 }; 3 }()`, 1},
+		{`fn() { try { throw 1 } catch (e) { return e + 1 }; 3 }()`, 2},
+		{`let n = 0; let f = fn() { try { return 1 } finally { n += 10 } }; f() + n`, 11},
+		{`let n = 0; let f = fn() { try { throw 1 } catch (e) { return e } finally { n += 10 } }; f() + n`, 11},
+		{`let log = []; let f = fn() { try { try { return 1 } finally { log = push(log, 1) } } finally { log = push(log, 2) } }; f(); log`, []int{1, 2}},
+		// finally can override the return value by returning itself
+		{`fn() { try { return 1 } finally { return 2 } }()`, 2},
+		{`fn() { try { throw 1 } finally { return 2 } }()`, 2},
+		// an error raised by a finally run by return goes to the enclosing
+		// tries, not to the one being left
+		{`fn() { try { try { return 1 } catch (e) { 10 } finally { throw 2 } } catch (e) { e * 100 } }()`, 200},
+		{`fn() { try { try { return 1 } catch (e) { 10 } } finally { 5 } }()`, 1},
+		// break and continue run the finally blocks of the tries inside the
+		// loop
+		{`let n = 0; let i = 0; while (true) { try { i += 1; if (i == 3) { break } } finally { n += 1 } }; [i, n]`, []int{3, 3}},
+		{`let n = 0; for (let i = 0; i < 4; i += 1) { try { if (i % 2 == 0) { continue }; n += 10 } finally { n += 1 } }; n`, 24},
+		{`let n = 0; for (let i = 0; i < 3; i += 1) { try { throw i } catch (e) { if (e == 1) { break } } finally { n += 1 } }; n`, 2},
+		{`let n = 0; try { while (true) { try { break } finally { n += 1 } } } finally { n += 10 }; n`, 11},
+		{`let n = 0; try { for (let i = 0; i < 3; i += 1) { if (i == 1) { continue }; n += 1 } } finally { n += 100 }; n`, 102},
+		{`let i = 0; while (i < 3) { try { i += 1; throw i } catch (e) { continue } }; i`, 3},
+		// a finally can leave the loop itself
+		{`let n = 0; while (true) { try { throw 1 } finally { break } }; n`, 0},
+		{`let n = 0; for (let i = 0; i < 3; i += 1) { try { n += 1 } finally { continue } }; n`, 3},
+		// generators suspend and resume inside every part of a try
+		{`let g = fn() { try { yield(1); throw 2 } catch (e) { yield(e * 10) } finally { yield(3) } }(); next(g)["value"] + next(g)["value"] + next(g)["value"]`, 24},
+		{`let g = fn() { try { yield(1) } catch (e) { e + 1 } }(); next(g); resume(g, 5)["value"]`, 5},
+		{`let g = fn() { try { yield(1); 0 } finally { return 9 } }(); next(g); next(g)["value"]`, 9},
+		{`let g = fn() { while (true) { try { yield(1); break } finally { yield(2) } }; 3 }(); [next(g)["value"], next(g)["value"], next(g)["value"]]`, []int{1, 2, 3}},
+	}
+
+	runVmTests(t, tests)
+
+	// a return at the top level runs finally too
+	runVmTests(t, []vmTestCase{
+		{`let n = 1; try { return n } finally { n = 2 }; 5`, 1},
+	})
+
+	runVmErrorTests(t, []vmTestCase{
+		{`fn() { try { try { return 1 } catch (e) { e } } finally { throw 3 } }()`, "uncaught exception: 3"},
+		{`fn() { while (true) { try { break } catch (e) { 0 } finally { throw 4 } } }()`, "uncaught exception: 4"},
+	}, func(vm *VM) {})
+}
+
+func TestCallAfterRethrowFromCatch(t *testing.T) {
+	symbolTable := compiler.NewSymbolTable()
+	symbolTable.DefineBuiltins(compilerObject.NewRegistry())
+
+	comp := compiler.NewWithState([]object.Object{}, symbolTable)
+	err := comp.Compile(parse(`let f = fn() { try { 1 / 0 } catch (e) { throw e } }; let g = fn() { 1 }`))
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	vm := New(comp.ByteCode())
+	err = vm.Run()
+	if err != nil {
+		t.Fatalf("vm error: %s", err)
+	}
+
+	globals := vm.Globals(symbolTable)
+	f, _ := globals.Get("f")
+	g, _ := globals.Get("g")
+
+	sp, framesIndex := vm.sp, vm.framesIndex
+
+	_, err = vm.Call(f)
+	if err == nil || err.Error() != "uncaught exception: Error: division by zero" {
+		t.Fatalf("wrong error. got=%v", err)
+	}
+	if vm.sp != sp || vm.framesIndex != framesIndex {
+		t.Fatalf("failed call left the VM changed. sp=%d (was %d), framesIndex=%d (was %d)",
+			vm.sp, sp, vm.framesIndex, framesIndex)
+	}
+
+	result, err := vm.Call(g)
+	if err != nil {
+		t.Fatalf("vm error: %s", err)
+	}
+	testExpectedObject(t, 1, result)
+}
+
+func TestGenerators(t *testing.T) {
+	tests := []vmTestCase{
+		{`let g = fn() { yield(1); yield(2) }(); next(g)["value"]`, 1},
+		{`let g = fn() { yield(1); yield(2) }(); next(g); next(g)["value"]`, 2},
+		{`let g = fn() { yield(1) }(); next(g)["done"]`, false},
+		// the return value comes with done set, after which only Null is left
+		{`let g = fn() { yield(1); 3 }(); next(g); next(g)["value"]`, 3},
+		{`let g = fn() { yield(1); 3 }(); next(g); next(g)["done"]`, true},
+		{`let g = fn() { yield(1) }(); next(g); next(g); next(g)["value"]`, Null},
+		{`let g = fn() { yield(1) }(); next(g); next(g); next(g)["done"]`, true},
+		{`let g = fn() { yield(1) }(); !next(g)["done"]`, true},
+		{`let g = fn() { yield(1) }(); next(g); !next(g)["done"]`, false},
+		{`
+		let g = fn() { yield(1); yield(2); yield(3) }();
+		let sum = 0;
+		let r = next(g);
+		while (!r["done"]) { sum += r["value"]; r = next(g) };
+		sum
+		`, 6},
+		// the body doesn't run until the first resume
+		{"let n = 0; let g = fn() { n = 1; yield(n) }(); n", 0},
+		{"let n = 0; let g = fn() { n = 1; yield(n) }(); next(g); n", 1},
+		// locals, parameters and pending operands survive a yield
+		{`let g = fn(a) { let b = 2; yield(a); a + b }(1); next(g); next(g)["value"]`, 3},
+		{`let g = fn(a) { let x = a + yield(a); x * 10 }(1); next(g); resume(g, 5)["value"]`, 60},
+		{`let g = fn(a) { [a, yield(a), a + 1] }(1); next(g); resume(g, 5)["value"]`, []int{1, 5, 2}},
+		// resume passes a value back as the result of the yield, which is
+		// dropped by the first resume
+		{`let g = fn() { let x = yield(1); yield(x * 10) }(); next(g); resume(g, 5)["value"]`, 50},
+		{`let g = fn() { yield(1) }(); resume(g, 5)["value"]`, 1},
+		// generators from the same function are independent
+		{`let f = fn(x) { yield(x); yield(x + 1) }; let a = f(1); let b = f(10); next(a); next(a)["value"] + next(b)["value"]`, 12},
+		// captured locals stay shared between the generator and closures
+		{`
+		let g = fn() { let n = 1; let inc = fn() { n += 1; n }; yield(inc); yield(n) }();
+		let inc = next(g)["value"];
+		inc(); inc();
+		next(g)["value"]
+		`, 3},
+		{`
+		let g = fn() { let n = 1; yield(fn() { n }); n = 5; yield(0) }();
+		let get = next(g)["value"];
+		next(g);
+		get()
+		`, 5},
+		// generators can be consumed lazily and drive each other
+		{`
+		let take = fn(g, n, acc) { if (n == 0) { acc } else { let r = next(g); if (r["done"]) { acc } else { take(g, n - 1, push(acc, r["value"])) } } };
+		let ones = fn() { yield(1); yield(1); yield(1); yield(1) };
+		take(ones(), 3, [])
+		`, []int{1, 1, 1}},
+		{`
+		let take = fn(g, n, acc) { if (n == 0) { acc } else { let r = next(g); if (r["done"]) { acc } else { take(g, n - 1, push(acc, r["value"])) } } };
+		take(fn() { yield(1); yield(2) }(), 5, [])
+		`, []int{1, 2}},
+		{`
+		let source = fn() { yield(1); yield(2); yield(3) };
+		let doubled = fn(g) { let a = next(g)["value"]; yield(a * 2); let b = next(g)["value"]; yield(b * 2) };
+		let d = doubled(source());
+		next(d)["value"] + next(d)["value"]
+		`, 6},
+		// a generator can be suspended inside a try, whose handler only
+		// catches while the generator runs
+		{`let g = fn() { try { yield(1)() } catch (e) { e + 1 } }(); next(g); resume(g, fn() { throw 41 })["value"]`, 42},
+		{`let g = fn() { try { throw 1 } catch (e) { yield(0)(e) } }(); next(g); resume(g, fn(e) { e + 10 })["value"]`, 11},
+		{`
+		let g = fn() { [1, try { yield(0)() } catch (e) { e }] }();
+		next(g);
+		try { throw "outside" } catch (e) { e } + resume(g, fn() { throw "inside" })["value"][1]
+		`, "outsideinside"},
+		// errors inside a generator finish it
+		{`let g = fn() { throw "boom"; yield(1) }(); try { next(g) } catch (e) { e }`, "boom"},
+		{`let g = fn() { throw "boom"; yield(1) }(); try { next(g) } catch (e) { e }; next(g)["done"]`, true},
+		{`let g = fn() { yield(try { throw 1 } catch (e) { e + 1 }) }(); next(g)["value"]`, 2},
+		{`map([1, 2], fn(x) { let g = fn() { yield(x * 2) }(); next(g)["value"] })`, []int{2, 4}},
+		{`next(1)`, &object.Error{Message: "argument to `next` must be GENERATOR, got INTEGER"}},
+	}
+
+	runVmTests(t, tests)
+
+	runVmErrorTests(t, []vmTestCase{
+		{`let g = fn() { yield(next(g)) }(); next(g)`, "generator is already running"},
+		{`fn(a) { yield(a) }()`, "wrong number of arguments: want=1, got=0"},
+	}, func(vm *VM) {})
+}
+
+func TestTasks(t *testing.T) {
+	tests := []vmTestCase{
+		{`let ch = channel(); spawn(fn() { send(ch, 42) }); receive(ch)["value"]`, 42},
+		{`let ch = channel(); spawn(fn(a, b) { send(ch, a + b) }, 1, 2); receive(ch)["value"]`, 3},
+		{`let ch = channel(); spawn(fn() { send(ch, 1) }); receive(ch)["done"]`, false},
+		{`let ch = channel(2); send(ch, 1); send(ch, 2); receive(ch)["value"] * 10 + receive(ch)["value"]`, 12},
+		{`
+		let ch = channel();
+		spawn(fn() { send(ch, 1); send(ch, 2); send(ch, 3); close(ch) });
+		let drain = fn(acc) { let r = receive(ch); if (r["done"]) { acc } else { drain(push(acc, r["value"])) } };
+		drain([])
+		`, []int{1, 2, 3}},
+		// a receiver sees the buffered values before the channel is done
+		{`let ch = channel(2); send(ch, 1); close(ch); receive(ch)["value"]`, 1},
+		{`let ch = channel(2); send(ch, 1); close(ch); receive(ch); receive(ch)["done"]`, true},
+		{`let ch = channel(); spawn(fn() { close(ch) }); receive(ch)["done"]`, true},
+		{`let ch = channel(); spawn(fn() { send(ch, 1) }); !receive(ch)["done"]`, true},
+		{`let ch = channel(); close(ch); !receive(ch)["done"]`, false},
+		{`
+		let ch = channel();
+		spawn(fn() { send(ch, 1); send(ch, 2); send(ch, 3); close(ch) });
+		let acc = [];
+		let r = receive(ch);
+		while (!r["done"]) { acc = push(acc, r["value"]); r = receive(ch) };
+		acc
+		`, []int{1, 2, 3}},
+		// senders blocked on a full buffer move into it in order
+		{`
+		let ch = channel(1);
+		spawn(fn() { send(ch, 1); send(ch, 2); send(ch, 3) });
+		let done = channel(); spawn(fn() { send(done, true) }); receive(done);
+		receive(ch)["value"] * 100 + receive(ch)["value"] * 10 + receive(ch)["value"]
+		`, 123},
+		// tasks start in the order they were spawned
+		{`
+		let log = channel(2);
+		let done = channel();
+		spawn(fn() { send(log, "a"); send(done, true) });
+		spawn(fn() { send(log, "b"); send(done, true) });
+		receive(done); receive(done);
+		receive(log)["value"] + receive(log)["value"]
+		`, "ab"},
+		{`
+		let results = channel();
+		let worker = fn(n) { send(results, n * n) };
+		spawn(worker, 1); spawn(worker, 2); spawn(worker, 3);
+		receive(results)["value"] + receive(results)["value"] + receive(results)["value"]
+		`, 14},
+		// tasks share the globals and captured variables
+		{"let x = 0; let done = channel(); spawn(fn() { x = 5; send(done, true) }); receive(done); x", 5},
+		{"fn() { let x = 1; let done = channel(); spawn(fn() { x += 1; send(done, true) }); receive(done); x }()", 2},
+		{`let ch = channel(); spawn(puts, "hello world"); spawn(len, [1]); 1`, 1},
+		// a deadlock is an ordinary runtime error
+		{`try { receive(channel()) } catch (e) { e }`, &object.Error{Message: "deadlock: all tasks are blocked"}},
+		{`let ch = channel(); spawn(fn() { receive(ch) }); try { receive(ch) } catch (e) { e }`, &object.Error{Message: "deadlock: all tasks are blocked"}},
+		{`let ch = channel(); close(ch); try { send(ch, 1) } catch (e) { e }`, &object.Error{Message: "send on closed channel"}},
+		{`spawn(1)`, &object.Error{Message: "argument to `spawn` must be a function, got INTEGER"}},
+		{`send(1, 2)`, &object.Error{Message: "argument to `send` must be CHANNEL, got INTEGER"}},
+		{`channel(-1)`, &object.Error{Message: "argument to `channel` must be a non-negative INTEGER, got -1"}},
+	}
+
+	runVmTests(t, tests)
+
+	runVmErrorTests(t, []vmTestCase{
+		{`let ch = channel(); close(ch); close(ch)`, "close of closed channel"},
+		{`let ch = channel(); spawn(fn() { send(ch, 1) }); close(ch); receive(ch)`, "task 1: send on closed channel"},
+		{`spawn(fn() { 1 / 0 }); 1`, "task 1: division by zero"},
+		{`let ch = channel(); spawn(fn() { throw "boom" }); receive(ch)`, "task 1: uncaught exception: boom"},
+		// task failures can't be caught
+		{`let ch = channel(); spawn(fn() { throw "boom" }); try { receive(ch) } catch (e) { 0 }`, "task 1: uncaught exception: boom"},
+		{`let ch = channel(); spawn(fn() { send(ch, 1) }); spawn(fn() { receive(ch); throw 2 }); spawn(fn() { 3 }); receive(channel())`, "task 2: uncaught exception: 2"},
+	}, func(vm *VM) {})
+
+	// spawned tasks share the instruction limit
+	runVmErrorTests(t, []vmTestCase{
+		{`spawn(fn() { let f = fn() { f() }; f() }); 1`, "task 1: instruction limit exceeded: 100"},
+	}, func(vm *VM) { vm.SetLimits(Limits{MaxInstructions: 100}) })
+}
+
+func TestTasksAfterMainProgram(t *testing.T) {
+	symbolTable := compiler.NewSymbolTable()
+	symbolTable.DefineBuiltins(compilerObject.NewRegistry())
+
+	comp := compiler.NewWithState([]object.Object{}, symbolTable)
+	err := comp.Compile(parse(`
+		let ran = 0;
+		let blocked = 0;
+		let ch = channel();
+		spawn(fn() { ran += 1 });
+		spawn(fn() { receive(ch); blocked += 1 });
+		spawn(fn() { try { receive(ch) } catch (e) { blocked += 1 } });
+		"done"
+	`))
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	vm := New(comp.ByteCode())
+	result, err := vm.RunProgram()
+	if err != nil {
+		t.Fatalf("vm error: %s", err)
+	}
+	testExpectedObject(t, "done", result)
+
+	// the tasks that could run did, and the blocked ones were cancelled
+	// without running any more of their code
+	globals := vm.Globals(symbolTable)
+	ran, _ := globals.Get("ran")
+	testExpectedObject(t, 1, ran)
+	blocked, _ := globals.Get("blocked")
+	testExpectedObject(t, 0, blocked)
+}
+
+func TestTasksSpawnedByCall(t *testing.T) {
+	comp := compiler.New()
+	err := comp.Compile(parse(`
+		let ran = [0];
+		let ch = channel();
+		let start = fn() {
+			spawn(fn() { ran[0] = ran[0] + 1 });
+			spawn(fn() { receive(ch) });
+			ran
+		};
+		start
+	`))
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	vm := New(comp.ByteCode())
+	err = vm.Run()
+	if err != nil {
+		t.Fatalf("vm error: %s", err)
+	}
+	start := vm.LastPoppedStackElem()
+
+	before := runtime.NumGoroutine()
+
+	for i := 1; i <= 3; i++ {
+		// the tasks ran or were cancelled before the Call returned
+		result, err := vm.Call(start)
+		if err != nil {
+			t.Fatalf("call error: %s", err)
+		}
+		testExpectedObject(t, []int{i}, result)
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for runtime.NumGoroutine() > before && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if after := runtime.NumGoroutine(); after > before {
+		t.Errorf("goroutines of spawned tasks leaked. before=%d, after=%d", before, after)
+	}
+}
+
+func TestTaskPreemption(t *testing.T) {
+	// without preemption the main program would spin until it overflows
+	input := `
+	let flag = false;
+	spawn(fn() { flag = true });
+	let spin = fn(n) { if (flag) { n } else { spin(n + 1) } };
+	spin(0)
+	`
+
+	run := func(scheduling Scheduling) object.Object {
+		comp := compiler.New()
+		err := comp.Compile(parse(input))
+		if err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+
+		vm := New(comp.ByteCode())
+		vm.SetScheduling(scheduling)
+		result, err := vm.RunProgram()
+		if err != nil {
+			t.Fatalf("vm error: %s", err)
+		}
+		return result
+	}
+
+	deterministic := Scheduling{Deterministic: true, InstructionSlice: 50}
+	first := run(deterministic)
+	second := run(deterministic)
+	if !objectsEqual(first, second, nil) {
+		t.Errorf("deterministic runs differ. got=%s and %s", first.Inspect(), second.Inspect())
+	}
+	if first.(*object.Integer).Value == 0 {
+		t.Errorf("main program didn't run before being preempted")
+	}
+
+	result := run(Scheduling{TimeSlice: time.Nanosecond})
+	if _, ok := result.(*object.Integer); !ok {
+		t.Errorf("wrong result with a time slice. got=%s", result.Inspect())
+	}
+}
+
+func TestInternalErrors(t *testing.T) {
+	tests := []struct {
+		instructions []code.Instructions
+		expectedIp   int
+		expectedOp   code.Opcode
+	}{
+		{
+			// stack underflow
+			[]code.Instructions{
+				code.Make(code.OpPop),
+			},
+			0,
+			code.OpPop,
+		},
+		{
+			// reading an unset global
+			[]code.Instructions{
+				code.Make(code.OpTrue),
+				code.Make(code.OpGetGlobal, 0),
+				code.Make(code.OpMinus),
+			},
+			4,
+			code.OpMinus,
+		},
+	}
+
+	for _, tt := range tests {
+		var instructions code.Instructions
+		for _, ins := range tt.instructions {
+			instructions = append(instructions, ins...)
+		}
+
+		vm := New(&compiler.ByteCode{Instructions: instructions})
+		err := vm.Run()
+		if err == nil {
+			t.Fatalf("expected VM error but resulted in none.")
+		}
+
+		internalErr, ok := err.(*InternalError)
+		if !ok {
+			t.Fatalf("error is not *InternalError. got=%T (%+v)", err, err)
+		}
+		if internalErr.Ip != tt.expectedIp {
+			t.Errorf("wrong ip. want=%d, got=%d", tt.expectedIp, internalErr.Ip)
+		}
+		if internalErr.Opcode != tt.expectedOp {
+			t.Errorf("wrong opcode. want=%d, got=%d", tt.expectedOp, internalErr.Opcode)
+		}
+		if internalErr.FramesIndex != 0 {
+			t.Errorf("wrong frame. want=0, got=%d", internalErr.FramesIndex)
+		}
+	}
+}
+
+type vmTestCase struct {
+	input    string
+	expected interface{}
+}
+
+func runVmTests(t *testing.T, tests []vmTestCase) {
+	t.Helper()
+
+	for _, tt := range tests {
+		program := parse(tt.input)
+
+		comp := compiler.New()
+		err := comp.Compile(program)
+		if err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+
+		vm := New(comp.ByteCode())
+		err = vm.Run()
+		if err != nil {
+			t.Fatalf("vm error: %s", err)
+		}
+
+		stackElem := vm.LastPoppedStackElem()
+
+		testExpectedObject(t, tt.expected, stackElem)
+	}
+}
+
+func runVmErrorTests(t *testing.T, tests []vmTestCase, configure func(vm *VM)) {
+	t.Helper()
+
+	for _, tt := range tests {
+		program := parse(tt.input)
+
+		comp := compiler.New()
+		err := comp.Compile(program)
+		if err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+
+		vm := New(comp.ByteCode())
+		configure(vm)
+
+		err = vm.Run()
+		if err == nil {
+			t.Fatalf("expected VM error but resulted in none. input=%q", tt.input)
+		}
+		if err.Error() != tt.expected {
+			t.Errorf("wrong VM error: want=%q, got=%q", tt.expected, err)
+		}
+	}
+}
+
+func testExpectedObject(t *testing.T, expected interface{}, actual object.Object) {
+	t.Helper()
+	switch expected := expected.(type) {
+
+	case int:
+		err := testIntegerObject(int64(expected), actual)
+		if err != nil {
+			t.Errorf("testIntegerObject failed: %s", err)
+		}
+
+	case float64:
+		err := testFloatObject(expected, actual)
+		if err != nil {
+			t.Errorf("testFloatObject failed: %s", err)
+		}
+
+	case *big.Int:
+		err := testBigIntegerObject(expected, actual)
+		if err != nil {
+			t.Errorf("testBigIntegerObject failed: %s", err)
+		}
+
+	case bool:
 		err := testBooleanObject(expected, actual)
 		if err != nil {
 			t.Errorf("testBooleanObject failed: %s", err)
@@ -715,3 +2377,90 @@ func testStringObject(expected string, actual object.Object) error {
 
 	return nil
 }
+
+func testFloatObject(expected float64, actual object.Object) error {
+	result, ok := actual.(*compilerObject.Float)
+	if !ok {
+		return fmt.Errorf("object is not float. got=%T (%+v)",
+			actual, actual)
+	}
+
+	if result.Value != expected {
+		return fmt.Errorf("object has wrong value.\n got=%g,\nwant=%g",
+			result.Value, expected)
+	}
+
+	return nil
+}
+
+func bigInt(s string) *big.Int {
+	value, ok := new(big.Int).SetString(s, 10)
+	if !ok {
+		panic("invalid big integer " + s)
+	}
+	return value
+}
+
+func testBigIntegerObject(expected *big.Int, actual object.Object) error {
+	result, ok := actual.(*compilerObject.BigInteger)
+	if !ok {
+		return fmt.Errorf("object is not big integer. got=%T (%+v)",
+			actual, actual)
+	}
+
+	if result.Value.Cmp(expected) != 0 {
+		return fmt.Errorf("object has wrong value.\n got=%s,\nwant=%s",
+			result.Value, expected)
+	}
+
+	return nil
+}
+
+func BenchmarkSmallIntegerArithmetic(b *testing.B) {
+	benchmarkProgram(b, `
+		let fibonacci = fn(x) {
+			if (x < 2) { return x; }
+			fibonacci(x - 1) + fibonacci(x - 2);
+		};
+		fibonacci(20);
+	`)
+}
+
+func BenchmarkBigIntegerArithmetic(b *testing.B) {
+	benchmarkProgram(b, `
+		let power = fn(base, exponent) {
+			if (exponent == 0) { return 1; }
+			base * power(base, exponent - 1);
+		};
+		power(3, 200);
+	`)
+}
+
+func BenchmarkMapBuiltin(b *testing.B) {
+	benchmarkProgram(b, `
+		let numbers = fn(n) {
+			let build = fn(i, acc) { if (i == n) { acc } else { build(i + 1, push(acc, i)) } };
+			build(0, [])
+		};
+		let array = numbers(500);
+		reduce(map(array, fn(x) { x * 2 }), 0, fn(acc, x) { acc + x });
+	`)
+}
+
+func benchmarkProgram(b *testing.B, input string) {
+	comp := compiler.New()
+	err := comp.Compile(parse(input))
+	if err != nil {
+		b.Fatalf("compiler error: %s", err)
+	}
+	byteCode := comp.ByteCode()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		vm := New(byteCode)
+		err := vm.Run()
+		if err != nil {
+			b.Fatalf("vm error: %s", err)
+		}
+	}
+}